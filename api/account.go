@@ -0,0 +1,459 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/404cn/gowarden/ds"
+)
+
+// Switch the KDF clients derive the master key with. The client sends the
+// new master password hash and the account's key encrypted with the new
+// master key, other clients have to log in again.
+func (apiHandler *APIHandler) HandleChangeKdf(w http.ResponseWriter, r *http.Request) {
+	var rkdf struct {
+		Kdf                   int    `json:"kdf"`
+		KdfIterations         int    `json:"kdfIterations"`
+		KdfMemory             int    `json:"kdfMemory"`
+		KdfParallelism        int    `json:"kdfParallelism"`
+		MasterPasswordHash    string `json:"masterPasswordHash"`
+		NewMasterPasswordHash string `json:"newMasterPasswordHash"`
+		Key                   string `json:"key"`
+	}
+
+	err := decodeJSON(r, &rkdf)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	v.plain("MasterPasswordHash", rkdf.MasterPasswordHash, maxMasterPasswordLength, true)
+	v.plain("NewMasterPasswordHash", rkdf.NewMasterPasswordHash, maxMasterPasswordLength, true)
+	v.encString("Key", rkdf.Key, maxEncStringLength, true)
+	validateKdf(&v, ds.Account{
+		Kdf:            rkdf.Kdf,
+		KdfIterations:  rkdf.KdfIterations,
+		KdfMemory:      rkdf.KdfMemory,
+		KdfParallelism: rkdf.KdfParallelism,
+	})
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+	apiHandler.logger.Infof("%v is trying to change the kdf.", email)
+
+	acc, err := apiHandler.checkPassword(email, rkdf.MasterPasswordHash)
+	if err == errWrongPassword {
+		apiHandler.handleError(w, validationError("MasterPasswordHash", "Invalid password."))
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	acc.Kdf, acc.KdfIterations = rkdf.Kdf, rkdf.KdfIterations
+	acc.KdfMemory, acc.KdfParallelism = 0, 0
+	if acc.Kdf == ds.KdfArgon2id {
+		acc.KdfMemory, acc.KdfParallelism = rkdf.KdfMemory, rkdf.KdfParallelism
+	}
+	acc.Key = rkdf.Key
+
+	acc.MasterPasswordHash, err = apiHandler.passwordHash.hash(rkdf.NewMasterPasswordHash)
+	if err != nil {
+		apiHandler.handleError(w, badRequest("The new master password hash is not base64."))
+		return
+	}
+
+	err = apiHandler.db.UpdateKdf(acc)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+}
+
+// Change the master password. The client sends the new master password hash
+// and the account's key encrypted with the new master key, other clients
+// have to log in again.
+func (apiHandler *APIHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var rpassword struct {
+		MasterPasswordHash    string `json:"masterPasswordHash"`
+		NewMasterPasswordHash string `json:"newMasterPasswordHash"`
+		MasterPasswordHint    string `json:"masterPasswordHint"`
+		Key                   string `json:"key"`
+	}
+
+	err := decodeJSON(r, &rpassword)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	v.plain("MasterPasswordHash", rpassword.MasterPasswordHash, maxMasterPasswordLength, true)
+	v.plain("NewMasterPasswordHash", rpassword.NewMasterPasswordHash, maxMasterPasswordLength, true)
+	v.plain("MasterPasswordHint", rpassword.MasterPasswordHint, maxPlainPasswordHint, false)
+	v.encString("Key", rpassword.Key, maxEncStringLength, true)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+	apiHandler.logger.Infof("%v is trying to change the master password.", email)
+
+	acc, err := apiHandler.checkPassword(email, rpassword.MasterPasswordHash)
+	if err == errWrongPassword {
+		apiHandler.handleError(w, validationError("MasterPasswordHash", "Invalid password."))
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	hash, err := apiHandler.passwordHash.hash(rpassword.NewMasterPasswordHash)
+	if err != nil {
+		apiHandler.handleError(w, badRequest("The new master password hash is not base64."))
+		return
+	}
+
+	err = apiHandler.db.UpdateMasterPassword(acc.Id, hash, rpassword.MasterPasswordHint, rpassword.Key)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+}
+
+// Log out every session of the account, including this one.
+func (apiHandler *APIHandler) HandleSecurityStamp(w http.ResponseWriter, r *http.Request) {
+	acc, err := apiHandler.verifyMasterPassword(r)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	err = apiHandler.db.RotateSecurityStamp(acc.Id)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.logger.Infof("Logged out every session of %v.", acc.Email)
+}
+
+// Ask for a token verifying the new address of an email change. There is no
+// mail server to send it to the new address, so it's logged.
+func (apiHandler *APIHandler) HandleEmailToken(w http.ResponseWriter, r *http.Request) {
+	var remail struct {
+		NewEmail           string `json:"newEmail"`
+		MasterPasswordHash string `json:"masterPasswordHash"`
+	}
+
+	err := decodeJSON(r, &remail)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	v.email("NewEmail", remail.NewEmail)
+	v.plain("MasterPasswordHash", remail.MasterPasswordHash, maxMasterPasswordLength, true)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+	apiHandler.logger.Infof("%v is trying to change the email to %v.", email, remail.NewEmail)
+
+	if !apiHandler.logEmailTokens {
+		apiHandler.logger.Info("Email changes are disabled, there is no way to send the token.")
+		writeError(w, http.StatusBadRequest, "Changing the email is disabled on this server.")
+		return
+	}
+
+	acc, err := apiHandler.checkPassword(email, remail.MasterPasswordHash)
+	if err == errWrongPassword {
+		apiHandler.handleError(w, validationError("MasterPasswordHash", "Invalid password."))
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	if err = apiHandler.checkEmailFree(remail.NewEmail); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	token, err := createEmailToken()
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	err = apiHandler.db.SetEmailToken(acc.Id, remail.NewEmail, token, time.Now().Add(emailTokenExpiresin*time.Second))
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	// The only way to deliver it, see SetLogEmailTokens.
+	apiHandler.logger.Infof("Token to change the email of %v to %v: %v", acc.Email, remail.NewEmail, token)
+}
+
+// Change the email of an account with the token sent to the new address. The
+// email salts the master key, so the client sends the master password hash
+// and the account's key derived from the new email, other clients have to
+// log in again.
+func (apiHandler *APIHandler) HandleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	var remail struct {
+		NewEmail              string `json:"newEmail"`
+		MasterPasswordHash    string `json:"masterPasswordHash"`
+		NewMasterPasswordHash string `json:"newMasterPasswordHash"`
+		Token                 string `json:"token"`
+		Key                   string `json:"key"`
+	}
+
+	err := decodeJSON(r, &remail)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	v.email("NewEmail", remail.NewEmail)
+	v.plain("MasterPasswordHash", remail.MasterPasswordHash, maxMasterPasswordLength, true)
+	v.plain("NewMasterPasswordHash", remail.NewMasterPasswordHash, maxMasterPasswordLength, true)
+	v.plain("Token", remail.Token, maxPlainNameLength, true)
+	v.encString("Key", remail.Key, maxEncStringLength, true)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+
+	acc, err := apiHandler.checkPassword(email, remail.MasterPasswordHash)
+	if err == errWrongPassword {
+		apiHandler.handleError(w, validationError("MasterPasswordHash", "Invalid password."))
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	// Counted before comparing so parallel guesses can't get around the limit.
+	attempts, err := apiHandler.db.CountEmailTokenAttempt(acc.Id)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	if acc.EmailToken == "" || acc.PendingEmail != remail.NewEmail || time.Now().After(acc.EmailTokenExpires) ||
+		attempts > maxEmailTokenAttempts || subtle.ConstantTimeCompare([]byte(acc.EmailToken), []byte(remail.Token)) != 1 {
+		apiHandler.logger.Infof("%v entered an invalid email token, attempt %v.", acc.Email, attempts)
+		apiHandler.handleError(w, validationError("Token", "Invalid token."))
+		return
+	}
+
+	// Somebody could have registered the address since the token was sent.
+	if err = apiHandler.checkEmailFree(remail.NewEmail); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	hash, err := apiHandler.passwordHash.hash(remail.NewMasterPasswordHash)
+	if err != nil {
+		apiHandler.handleError(w, badRequest("The new master password hash is not base64."))
+		return
+	}
+
+	err = apiHandler.db.UpdateEmail(acc.Id, remail.NewEmail, hash, remail.Key)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.logger.Infof("%v changed the email to %v.", acc.Email, remail.NewEmail)
+}
+
+// checkEmailFree returns a validation error if an account already uses email.
+func (apiHandler *APIHandler) checkEmailFree(email string) error {
+	_, err := apiHandler.db.GetAccount(email)
+	if err == nil {
+		return validationError("NewEmail", "Email already taken.")
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	return nil
+}
+
+// createEmailToken returns a random six digit token, short enough to be
+// typed from the email.
+func createEmailToken() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n), nil
+}
+
+// Delete the account with its whole vault and attachments.
+func (apiHandler *APIHandler) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	acc, err := apiHandler.verifyMasterPassword(r)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.logger.Infof("%v is trying to delete the account.", acc.Email)
+
+	cipherIds, err := apiHandler.db.DeleteAccount(acc.Id)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+	apiHandler.deleteAttachmentBlobs(cipherIds)
+
+	apiHandler.logger.Infof("Account %v deleted.", acc.Email)
+}
+
+// verifyMasterPassword returns the account of a request whose body carries
+// its master password hash, like the ones deleting data.
+func (apiHandler *APIHandler) verifyMasterPassword(r *http.Request) (ds.Account, error) {
+	var rsecret struct {
+		MasterPasswordHash string `json:"masterPasswordHash"`
+	}
+
+	err := decodeJSON(r, &rsecret)
+	if err != nil {
+		return ds.Account{}, err
+	}
+
+	var v validator
+	v.plain("MasterPasswordHash", rsecret.MasterPasswordHash, maxMasterPasswordLength, true)
+	if err = v.error(); err != nil {
+		return ds.Account{}, err
+	}
+
+	acc, err := apiHandler.checkPassword(getEmailRctx(r), rsecret.MasterPasswordHash)
+	if err == errWrongPassword {
+		return acc, validationError("MasterPasswordHash", "Invalid password.")
+	}
+	return acc, err
+}
+
+func (apiHandler *APIHandler) HandleGetProfile(w http.ResponseWriter, r *http.Request) {
+	acc, err := apiHandler.db.GetAccount(getEmailRctx(r))
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.writeProfile(w, acc)
+}
+
+// Update the name, master password hint and culture of the account.
+func (apiHandler *APIHandler) HandleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var rprofile struct {
+		Name               string `json:"name"`
+		MasterPasswordHint string `json:"masterPasswordHint"`
+		Culture            string `json:"culture"`
+	}
+
+	err := decodeJSON(r, &rprofile)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	v.plain("Name", rprofile.Name, maxPlainNameLength, false)
+	v.plain("MasterPasswordHint", rprofile.MasterPasswordHint, maxPlainPasswordHint, false)
+	v.plain("Culture", rprofile.Culture, maxPlainCultureLength, false)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	acc, err := apiHandler.db.GetAccount(getEmailRctx(r))
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	acc.Name, acc.MasterPasswordHint, acc.Culture = rprofile.Name, rprofile.MasterPasswordHint, rprofile.Culture
+	err = apiHandler.db.UpdateProfile(acc)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.writeProfile(w, acc)
+}
+
+// Set the avatar color of the account, null lets clients pick one.
+func (apiHandler *APIHandler) HandleUpdateAvatar(w http.ResponseWriter, r *http.Request) {
+	var ravatar struct {
+		AvatarColor *string `json:"avatarColor"`
+	}
+
+	err := decodeJSON(r, &ravatar)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	color := ""
+	if ravatar.AvatarColor != nil {
+		color = *ravatar.AvatarColor
+	}
+	if color != "" && !avatarColor.MatchString(color) {
+		apiHandler.handleError(w, validationError("AvatarColor", "The AvatarColor field is not a color like #aa00ff."))
+		return
+	}
+
+	acc, err := apiHandler.db.GetAccount(getEmailRctx(r))
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	acc.AvatarColor = color
+	err = apiHandler.db.UpdateProfile(acc)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.writeProfile(w, acc)
+}
+
+var avatarColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+func (apiHandler *APIHandler) writeProfile(w http.ResponseWriter, acc ds.Account) {
+	profile := acc.Profile()
+	d, err := json.Marshal(&profile)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
@@ -0,0 +1,398 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/404cn/gowarden/ds"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+)
+
+// register registers email with the base64 master password hash password.
+func register(t *testing.T, h *APIHandler, email, password string) {
+	w := httptest.NewRecorder()
+	h.HandleRegister(w, httptest.NewRequest(http.MethodPost, "/api/accounts/register", strings.NewReader(`{
+"email": "`+email+`",
+"masterPasswordHash": "`+password+`",
+"key": "`+testEncString+`",
+"kdf": 0,
+"kdfIterations": 100000,
+"keys": {"publicKey": "AAAA", "encryptedPrivateKey": "`+testEncString+`"}
+}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Register: response code is %v: %v", w.Code, w.Body)
+	}
+}
+
+func loginAs(h *APIHandler, email, password string) *httptest.ResponseRecorder {
+	form := url.Values{"grant_type": {"password"}, "username": {email}, "password": {password}}
+	req := httptest.NewRequest(http.MethodPost, "/identity/connect/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := httptest.NewRecorder()
+	h.HandleLogin(w, req)
+	return w
+}
+
+func TestHandleChangeKdf(t *testing.T) {
+	db, h := newSqliteHandler(t)
+	const email = "nobody@example.com"
+
+	register(t, h, email, "b2xk")
+	login := func(password string) *httptest.ResponseRecorder {
+		return loginAs(h, email, password)
+	}
+
+	w := login("b2xk")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Kdf":0,"KdfIterations":100000,"KdfMemory":null`) {
+		t.Fatalf("Login: %v %v", w.Code, w.Body)
+	}
+
+	for _, c := range []struct {
+		name  string
+		body  string
+		code  int
+		field string
+	}{
+		{"wrong password", `{"kdf": 1, "kdfIterations": 3, "kdfMemory": 64, "kdfParallelism": 4, "masterPasswordHash": "d3Jvbmc=", "newMasterPasswordHash": "bmV3", "key": "` + testEncString + `"}`, http.StatusBadRequest, "MasterPasswordHash"},
+		{"weak argon2id", `{"kdf": 1, "kdfIterations": 3, "kdfMemory": 1, "kdfParallelism": 4, "masterPasswordHash": "b2xk", "newMasterPasswordHash": "bmV3", "key": "` + testEncString + `"}`, http.StatusBadRequest, "KdfMemory"},
+		{"unknown kdf", `{"kdf": 7, "kdfIterations": 3, "masterPasswordHash": "b2xk", "newMasterPasswordHash": "bmV3", "key": "` + testEncString + `"}`, http.StatusBadRequest, "Kdf"},
+		{"plain key", `{"kdf": 1, "kdfIterations": 3, "kdfMemory": 64, "kdfParallelism": 4, "masterPasswordHash": "b2xk", "newMasterPasswordHash": "bmV3", "key": "key"}`, http.StatusBadRequest, "Key"},
+		{"argon2id", `{"kdf": 1, "kdfIterations": 3, "kdfMemory": 64, "kdfParallelism": 4, "masterPasswordHash": "b2xk", "newMasterPasswordHash": "bmV3", "key": "` + testEncString + `"}`, http.StatusOK, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.HandleChangeKdf(w, withEmail(httptest.NewRequest(http.MethodPost, "/api/accounts/kdf", strings.NewReader(c.body))))
+		if w.Code != c.code {
+			t.Errorf("%v: response code is %v, want %v: %v", c.name, w.Code, c.code, w.Body)
+			continue
+		}
+
+		if c.field != "" {
+			var res errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.ValidationErrors[c.field]) == 0 {
+				t.Errorf("%v: no error for %v, got %v", c.name, c.field, res.ValidationErrors)
+			}
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.HandlePrelogin(w, httptest.NewRequest(http.MethodPost, "/api/accounts/prelogin", strings.NewReader(`{"email": "`+email+`"}`)))
+	if got, want := strings.TrimSpace(w.Body.String()), `{"Kdf":1,"KdfIterations":3,"KdfMemory":64,"KdfParallelism":4}`; got != want {
+		t.Errorf("Prelogin returned %v, want %v", got, want)
+	}
+
+	acc, err := db.GetAccount(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.RefreshToken != "" {
+		t.Error("Other clients are still logged in")
+	}
+
+	if w = login("b2xk"); w.Code != http.StatusBadRequest {
+		t.Errorf("Login with the old password: response code is %v", w.Code)
+	}
+	if w = login("bmV3"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Kdf":1,"KdfIterations":3,"KdfMemory":64,"KdfParallelism":4`) {
+		t.Errorf("Login with the new password: %v %v", w.Code, w.Body)
+	}
+}
+
+func TestHandleChangeEmail(t *testing.T) {
+	db, h := newSqliteHandler(t)
+	const email, newEmail = "nobody@example.com", "somebody@example.com"
+
+	register(t, h, email, "b2xk")
+	register(t, h, "taken@example.com", "b2xk")
+
+	post := func(handle http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handle(w, withEmail(httptest.NewRequest(http.MethodPost, "/api/accounts/email", strings.NewReader(body))))
+		return w
+	}
+
+	requestToken := `{"newEmail": "` + newEmail + `", "masterPasswordHash": "b2xk"}`
+	if w := post(h.HandleEmailToken, requestToken); w.Code != http.StatusBadRequest {
+		t.Errorf("Token without a way to send it: response code is %v", w.Code)
+	}
+	h.SetLogEmailTokens(true)
+
+	for _, c := range []struct {
+		name string
+		body string
+	}{
+		{"wrong password", `{"newEmail": "` + newEmail + `", "masterPasswordHash": "d3Jvbmc="}`},
+		{"taken", `{"newEmail": "taken@example.com", "masterPasswordHash": "b2xk"}`},
+		{"invalid", `{"newEmail": "nobody", "masterPasswordHash": "b2xk"}`},
+	} {
+		if w := post(h.HandleEmailToken, c.body); w.Code != http.StatusBadRequest {
+			t.Errorf("Token %v: response code is %v: %v", c.name, w.Code, w.Body)
+		}
+	}
+
+	newToken := func() string {
+		if w := post(h.HandleEmailToken, requestToken); w.Code != http.StatusOK {
+			t.Fatalf("Token: response code is %v: %v", w.Code, w.Body)
+		}
+
+		acc, err := db.GetAccount(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acc.PendingEmail != newEmail || len(acc.EmailToken) != 6 {
+			t.Fatalf("Pending email %v with token %q", acc.PendingEmail, acc.EmailToken)
+		}
+		return acc.EmailToken
+	}
+	token := newToken()
+
+	change := func(newEmail, password, token string) string {
+		return `{"newEmail": "` + newEmail + `", "masterPasswordHash": "` + password + `", "newMasterPasswordHash": "bmV3", "token": "` + token + `", "key": "` + testEncString + `"}`
+	}
+
+	for _, c := range []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"wrong password", change(newEmail, "d3Jvbmc=", token), "MasterPasswordHash"},
+		{"wrong token", change(newEmail, "b2xk", "000000x"), "Token"},
+		{"other email", change("other@example.com", "b2xk", token), "Token"},
+	} {
+		w := post(h.HandleChangeEmail, c.body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: response code is %v: %v", c.name, w.Code, w.Body)
+			continue
+		}
+
+		var res errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.ValidationErrors[c.field]) == 0 {
+			t.Errorf("%v: no error for %v, got %v", c.name, c.field, res.ValidationErrors)
+		}
+	}
+
+	// Out of attempts after two wrong tokens and this one, even the right token fails.
+	post(h.HandleChangeEmail, change(newEmail, "b2xk", "000000x"))
+	if w := post(h.HandleChangeEmail, change(newEmail, "b2xk", token)); w.Code != http.StatusBadRequest {
+		t.Errorf("Change after %v attempts: response code is %v", maxEmailTokenAttempts, w.Code)
+	}
+
+	token = newToken()
+	if w := post(h.HandleChangeEmail, change(newEmail, "b2xk", token)); w.Code != http.StatusOK {
+		t.Fatalf("Change: response code is %v: %v", w.Code, w.Body)
+	}
+
+	if w := loginAs(h, email, "b2xk"); w.Code != http.StatusBadRequest {
+		t.Errorf("Login with the old email: response code is %v", w.Code)
+	}
+	if w := loginAs(h, newEmail, "b2xk"); w.Code != http.StatusBadRequest {
+		t.Errorf("Login with the old password: response code is %v", w.Code)
+	}
+	if w := loginAs(h, newEmail, "bmV3"); w.Code != http.StatusOK {
+		t.Errorf("Login with the new email: %v %v", w.Code, w.Body)
+	}
+
+	acc, err := db.GetAccount(newEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.EmailToken != "" || acc.PendingEmail != "" {
+		t.Error("The token can be used again")
+	}
+}
+
+func TestHandleDeleteAccount(t *testing.T) {
+	db, h := newSqliteHandler(t)
+	const email, other = "nobody@example.com", "somebody@example.com"
+
+	addAttachment := func(email string) string {
+		register(t, h, email, "b2xk")
+		acc, err := db.GetAccount(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher, err := db.AddCipher(ds.Cipher{Type: 2, Name: testEncString}, acc.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attachment := ds.Attachment{Id: uuid.New().String(), FileName: testEncString, Size: "4"}
+		if _, err = db.AddAttachment(acc.Id, cipher.Id, attachment); err != nil {
+			t.Fatal(err)
+		}
+		key := attachmentKey(cipher.Id, attachment.Id)
+		if err = h.blobs.Put(key, strings.NewReader("data"), 4); err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	key := addAttachment(email)
+	otherKey := addAttachment(other)
+
+	exists := func(key string) bool {
+		blob, err := h.blobs.Get(key)
+		if err != nil {
+			return false
+		}
+		blob.Close()
+		return true
+	}
+
+	post := func(handle http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handle(w, withEmail(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))))
+		return w
+	}
+
+	for _, handle := range []http.HandlerFunc{h.HandlePurgeCiphers, h.HandleDeleteAccount} {
+		if w := post(handle, `{"masterPasswordHash": "d3Jvbmc="}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Wrong password: response code is %v: %v", w.Code, w.Body)
+		}
+	}
+	if !exists(key) {
+		t.Fatal("Attachment deleted with a wrong password")
+	}
+
+	if w := post(h.HandlePurgeCiphers, `{"masterPasswordHash": "b2xk"}`); w.Code != http.StatusOK {
+		t.Fatalf("Purge: response code is %v: %v", w.Code, w.Body)
+	}
+	if exists(key) {
+		t.Error("Attachment of a purged cipher is still stored")
+	}
+	if w := loginAs(h, email, "b2xk"); w.Code != http.StatusOK {
+		t.Errorf("Login after purging: response code is %v", w.Code)
+	}
+
+	key = addAttachment("third@example.com")
+	if w := post(h.HandleDeleteAccount, `{"masterPasswordHash": "b2xk"}`); w.Code != http.StatusOK {
+		t.Fatalf("Delete: response code is %v: %v", w.Code, w.Body)
+	}
+	if w := loginAs(h, email, "b2xk"); w.Code != http.StatusBadRequest {
+		t.Errorf("Login after deleting the account: response code is %v", w.Code)
+	}
+
+	if !exists(otherKey) || !exists(key) {
+		t.Error("Attachments of other accounts were deleted")
+	}
+}
+
+func TestHandleProfile(t *testing.T) {
+	_, h := newSqliteHandler(t)
+	register(t, h, "nobody@example.com", "b2xk")
+
+	profile := func(handle http.HandlerFunc, method, body string) (int, ds.Profile) {
+		w := httptest.NewRecorder()
+		handle(w, withEmail(httptest.NewRequest(method, "/api/accounts/profile", strings.NewReader(body))))
+
+		var p ds.Profile
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, p
+	}
+
+	code, p := profile(h.HandleGetProfile, http.MethodGet, "")
+	if code != http.StatusOK || p.Name != nil || p.AvatarColor != nil || p.Culture != "en-US" || !p.Premium {
+		t.Errorf("New profile: %v %+v", code, p)
+	}
+
+	if code, _ = profile(h.HandleUpdateProfile, http.MethodPut, `{"name": "`+strings.Repeat("n", 51)+`"}`); code != http.StatusBadRequest {
+		t.Errorf("Too long name: response code is %v", code)
+	}
+	if code, _ = profile(h.HandleUpdateAvatar, http.MethodPut, `{"avatarColor": "red"}`); code != http.StatusBadRequest {
+		t.Errorf("Invalid avatar color: response code is %v", code)
+	}
+
+	if code, _ = profile(h.HandleUpdateProfile, http.MethodPut, `{"name": "Nobody", "masterPasswordHint": "hint", "culture": "de-DE"}`); code != http.StatusOK {
+		t.Fatalf("Update profile: response code is %v", code)
+	}
+	if code, _ = profile(h.HandleUpdateAvatar, http.MethodPut, `{"avatarColor": "#aa00ff"}`); code != http.StatusOK {
+		t.Fatalf("Update avatar: response code is %v", code)
+	}
+
+	_, p = profile(h.HandleGetProfile, http.MethodGet, "")
+	if p.Name == nil || *p.Name != "Nobody" || p.MasterPasswordHint != "hint" || p.Culture != "de-DE" ||
+		p.AvatarColor == nil || *p.AvatarColor != "#aa00ff" {
+		t.Errorf("Updated profile: %+v", p)
+	}
+
+	if _, p = profile(h.HandleUpdateAvatar, http.MethodPut, `{"avatarColor": null}`); p.AvatarColor != nil || p.Name == nil {
+		t.Errorf("Profile after clearing the avatar color: %+v", p)
+	}
+}
+
+func TestSecurityStamp(t *testing.T) {
+	_, h := newSqliteHandler(t)
+	const email = "nobody@example.com"
+	register(t, h, email, "b2xk")
+
+	accessToken := func(password string) string {
+		w := loginAs(h, email, password)
+		var res struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.AccessToken == "" {
+			t.Fatalf("Login: %v %v", w.Code, w.Body)
+		}
+		return res.AccessToken
+	}
+
+	call := func(handle http.HandlerFunc, token, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		w := httptest.NewRecorder()
+		h.AuthMiddleware(handle)(w, req)
+		return w.Code
+	}
+
+	token := accessToken("b2xk")
+	if code := call(h.HandleGetProfile, token, ""); code != http.StatusOK {
+		t.Fatalf("Fresh token: response code is %v", code)
+	}
+
+	if code := call(h.HandleChangePassword, token, `{"masterPasswordHash": "b2xk", "newMasterPasswordHash": "bmV3", "key": "`+testEncString+`"}`); code != http.StatusOK {
+		t.Fatalf("Change password: response code is %v", code)
+	}
+	if code := call(h.HandleGetProfile, token, ""); code != http.StatusUnauthorized {
+		t.Errorf("Token from before the password change: response code is %v", code)
+	}
+
+	token = accessToken("bmV3")
+	if code := call(h.HandleSecurityStamp, token, `{"masterPasswordHash": "d3Jvbmc="}`); code != http.StatusBadRequest {
+		t.Errorf("Log out with a wrong password: response code is %v", code)
+	}
+	if code := call(h.HandleSecurityStamp, token, `{"masterPasswordHash": "bmV3"}`); code != http.StatusOK {
+		t.Fatalf("Log out all sessions: response code is %v", code)
+	}
+	if code := call(h.HandleGetProfile, token, ""); code != http.StatusUnauthorized {
+		t.Errorf("Token from before logging out: response code is %v", code)
+	}
+
+	noStamp, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": email,
+	}).SignedString([]byte(h.signingKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := call(h.HandleGetProfile, noStamp, ""); code != http.StatusUnauthorized {
+		t.Errorf("Token without security stamp: response code is %v", code)
+	}
+
+	if code := call(h.HandleGetProfile, accessToken("bmV3"), ""); code != http.StatusOK {
+		t.Errorf("New login: response code is %v", code)
+	}
+}
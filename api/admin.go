@@ -0,0 +1,38 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HandleStorageUsage lists the attachment storage used by every account.
+func (apiHandler *APIHandler) HandleStorageUsage(w http.ResponseWriter, r *http.Request) {
+	apiHandler.logger.Info("Admin is trying to get storage usage.")
+
+	usages, err := apiHandler.db.GetStorageUsages()
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	for i := range usages {
+		usages[i].Quota = apiHandler.storageQuota
+	}
+
+	data := struct {
+		Data   interface{}
+		Object string
+	}{
+		Data:   usages,
+		Object: "list",
+	}
+
+	d, err := json.Marshal(&data)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/404cn/gowarden/ds"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// attachmentToken signs a short lived token allowing to download attachmentId of cipherId of account accId.
+func (apiHandler *APIHandler) attachmentToken(accId, cipherId, attachmentId string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"nbf": time.Now().Unix(),
+		"exp": time.Now().Add(time.Second * time.Duration(attachmentUrlExpiresin)).Unix(),
+		"iss": "gowarden|attachment",
+		"sub": attachmentId,
+		"cid": cipherId,
+		"aid": accId,
+	})
+
+	return token.SignedString([]byte(apiHandler.signingKey))
+}
+
+// checkAttachmentToken makes sure tokenString was signed by attachmentToken for
+// attachmentId of cipherId and didn't expire, returning the account it was signed for.
+func (apiHandler *APIHandler) checkAttachmentToken(tokenString, cipherId, attachmentId string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(apiHandler.signingKey), nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", errors.New("Invalid attachment token.")
+	}
+
+	if claims["iss"] != "gowarden|attachment" || claims["sub"] != attachmentId || claims["cid"] != cipherId {
+		return "", errors.New("Attachment token doesn't match the attachment.")
+	}
+
+	accId, ok := claims["aid"].(string)
+	if !ok {
+		return "", errors.New("Attachment token without account.")
+	}
+
+	return accId, nil
+}
+
+// attachmentUrl returns a signed download url of attachmentId of cipherId of account accId.
+func (apiHandler *APIHandler) attachmentUrl(r *http.Request, accId, cipherId, attachmentId string) (string, error) {
+	token, err := apiHandler.attachmentToken(accId, cipherId, attachmentId)
+	if err != nil {
+		return "", err
+	}
+
+	return apiHandler.baseURL(r) + "/attachments/" + cipherId + "/" + attachmentId + "?token=" + url.QueryEscape(token), nil
+}
+
+// baseURL returns the url r was sent to without the path, like
+// https://example.com, unless a domain is configured. Requests from trusted
+// proxies carry the scheme the client used in r.URL.Scheme.
+func (apiHandler *APIHandler) baseURL(r *http.Request) string {
+	if apiHandler.domain != "" {
+		return apiHandler.domain
+	}
+
+	scheme := r.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// signAttachments fills in fresh download urls for the attachments of ciphers of account accId.
+func (apiHandler *APIHandler) signAttachments(r *http.Request, accId string, ciphers []ds.Cipher) error {
+	for i := range ciphers {
+		for j := range ciphers[i].Attachments {
+			var err error
+			ciphers[i].Attachments[j].Url, err = apiHandler.attachmentUrl(r, accId, ciphers[i].Id, ciphers[i].Attachments[j].Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// HandleAttachmentInfo returns an attachment with a fresh download url,
+// clients call it right before downloading.
+func (apiHandler *APIHandler) HandleAttachmentInfo(w http.ResponseWriter, r *http.Request) {
+	email := getEmailRctx(r)
+	cipherId := mux.Vars(r)["cipherId"]
+	attachmentId := mux.Vars(r)["attachmentId"]
+
+	apiHandler.logger.Infof("%v is trying to get attachment %v.", email, attachmentId)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	attachment, err := apiHandler.db.GetAttachment(acc.Id, cipherId, attachmentId)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Attachment doesn't exist.")
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	attachment.Url, err = apiHandler.attachmentUrl(r, acc.Id, cipherId, attachmentId)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	d, err := json.Marshal(&attachment)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
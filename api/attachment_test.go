@@ -0,0 +1,189 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/404cn/gowarden/ds"
+	"github.com/404cn/gowarden/sqlite/mock"
+	"github.com/404cn/gowarden/storage"
+	"github.com/gorilla/mux"
+)
+
+func TestHandleGetAttachment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := New(mock.New(), "key", logT)
+	h.SetBlobStore(storage.NewFS(dir))
+
+	data := []byte("0123456789")
+	err = h.blobs.Put(attachmentKey("cipher", "attachment"), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/attachments/{cipherId}/{attachmentId}", h.HandleGetAttachment)
+
+	token, err := h.attachmentToken("account", "cipher", "attachment")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/attachments/cipher/attachment?token="+token, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Response code is %v", w.Code)
+	}
+	if w.Body.String() != "2345" || w.Header().Get("Content-Length") != "4" {
+		t.Errorf("Got %q with Content-Length %v", w.Body.String(), w.Header().Get("Content-Length"))
+	}
+	if w.Header().Get("Content-Disposition") == "" {
+		t.Error("No Content-Disposition header")
+	}
+
+	for _, url := range []string{
+		"/attachments/cipher/attachment",
+		"/attachments/cipher/attachment?token=foo",
+		"/attachments/cipher/other?token=" + token,
+	} {
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest(http.MethodGet, url, nil)
+		r.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%v: response code is %v", url, w.Code)
+		}
+	}
+}
+
+func TestAttachmentUrl(t *testing.T) {
+	h := New(mock.New(), "key", logT)
+
+	for _, c := range []struct {
+		domain string
+		scheme string
+		tls    bool
+		want   string
+	}{
+		{"", "", false, "http://example.com/attachments/"},
+		{"", "", true, "https://example.com/attachments/"},
+		{"", "https", false, "https://example.com/attachments/"},
+		{"https://vault.example.org/vault/", "", false, "https://vault.example.org/vault/attachments/"},
+	} {
+		h.SetDomain(c.domain)
+
+		// Like requests reaching the server, their urls have no scheme.
+		req, _ := http.NewRequest(http.MethodGet, "/api/sync", nil)
+		req.Host = "example.com"
+		req.URL.Scheme = c.scheme
+		if c.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		url, err := h.attachmentUrl(req, "account", "cipher", "attachment")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(url, c.want+"cipher/attachment?token=") {
+			t.Errorf("Got %v, want it to start with %v", url, c.want)
+		}
+	}
+}
+
+func TestHandleAddAttachmentLimits(t *testing.T) {
+	db, h := newSqliteHandler(t)
+	h.SetStorageLimits(8, 12)
+	h.SetAdminToken("admin")
+
+	if err := db.AddAccount(ds.Account{Email: "nobody@example.com", MasterPasswordHash: "hash"}); err != nil {
+		t.Fatal(err)
+	}
+	acc, err := db.GetAccount("nobody@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := db.AddCipher(ds.Cipher{Type: 2, Name: testEncString}, acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/ciphers/{cipherId}/attachment", h.HandleAddAttachment).Methods(http.MethodPost)
+	r.HandleFunc("/admin/usage", h.AdminMiddleware(h.HandleStorageUsage)).Methods(http.MethodGet)
+
+	upload := func(sizes ...int) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("key", testEncString)
+		for _, size := range sizes {
+			fw, _ := mw.CreateFormFile("data", "upload")
+			fw.Write(bytes.Repeat([]byte("a"), size))
+		}
+		mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/ciphers/"+cipher.Id+"/attachment", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, withEmail(req))
+		return w.Code
+	}
+
+	tests := []struct {
+		name  string
+		sizes []int
+		code  int
+	}{
+		{"no file", nil, http.StatusBadRequest},
+		{"two files", []int{1, 1}, http.StatusBadRequest},
+		{"over the max size", []int{9}, http.StatusRequestEntityTooLarge},
+		{"over the body limit", []int{multipartOverhead + 1}, http.StatusRequestEntityTooLarge},
+		{"fits", []int{8}, http.StatusOK},
+		{"over the quota", []int{8}, http.StatusBadRequest},
+		{"fills the quota", []int{4}, http.StatusOK},
+		{"quota is full", []int{1}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		if code := upload(test.sizes...); code != test.code {
+			t.Errorf("%v: got %v, want %v", test.name, code, test.code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/usage", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Got %v without the admin token", w.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var usages struct {
+		Data []ds.StorageUsage
+	}
+	if err = json.Unmarshal(w.Body.Bytes(), &usages); err != nil {
+		t.Fatal(err)
+	}
+	if len(usages.Data) != 1 {
+		t.Fatalf("Got %v usages", len(usages.Data))
+	}
+	if u := usages.Data[0]; u.Email != acc.Email || u.Attachments != 2 || u.Used != 12 || u.Quota != 12 {
+		t.Errorf("Got usage %+v", u)
+	}
+}
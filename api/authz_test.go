@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/404cn/gowarden/ds"
+	"github.com/404cn/gowarden/sqlite"
+	"github.com/404cn/gowarden/storage"
+	"github.com/gorilla/mux"
+)
+
+// newSqliteHandler returns a handler on a fresh sqlite database and blob
+// store in a temp dir, removed when the test ends.
+func newSqliteHandler(t *testing.T) (*sqlite.DB, *APIHandler) {
+	dir, err := ioutil.TempDir("", "gowarden-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := sqlite.New()
+	db.SetDir(dir)
+
+	t.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	if err = db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := New(db, "key", logT)
+	h.SetBlobStore(storage.NewFS(dir))
+	h.SetPasswordHash(testPasswordHash)
+	return db, h
+}
+
+// TestCrossAccount makes sure nobody can read or change the objects of
+// another account by using their ids.
+func TestCrossAccount(t *testing.T) {
+	db, h := newSqliteHandler(t)
+
+	var err error
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		if err = db.AddAccount(ds.Account{Email: email, MasterPasswordHash: "hash"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, _ := db.GetAccount("alice@example.com")
+	bob, _ := db.GetAccount("bob@example.com")
+
+	// Bob's vault.
+	folder, err := db.AddFolder(bob.Id, "2.folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := db.AddCipher(ds.Cipher{Type: 2, Name: "2.note", FolderId: folder.Id}, bob.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment := ds.Attachment{Id: "attachment", FileName: "2.file", Size: "4"}
+	if _, err = db.AddAttachment(bob.Id, cipher.Id, attachment); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.blobs.Put(attachmentKey(cipher.Id, attachment.Id), strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's own vault, to try moving her items into Bob's folder.
+	own, err := db.AddCipher(ds.Cipher{Type: 2, Name: "2.own"}, alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/sync", h.HandleSync).Methods(http.MethodGet)
+	r.HandleFunc("/api/ciphers", h.HandleCiphers).Methods(http.MethodPost)
+	r.HandleFunc("/api/ciphers/move", h.HandleMoveCiphers).Methods(http.MethodPut)
+	r.HandleFunc("/api/ciphers/{cipherId}", h.HandleUpdateCiphers).Methods(http.MethodPut)
+	r.HandleFunc("/api/ciphers/{cipherId}", h.HandleDeleteCiphers).Methods(http.MethodDelete)
+	r.HandleFunc("/api/ciphers/{cipherId}", h.HandleGetCipher).Methods(http.MethodGet)
+	r.HandleFunc("/api/ciphers/{cipherId}/details", h.HandleGetCipher).Methods(http.MethodGet)
+	r.HandleFunc("/api/ciphers/{cipherId}/partial", h.HandlePartialUpdateCipher).Methods(http.MethodPut)
+	r.HandleFunc("/api/folders/{folderUUID}", h.HandleGetFolder).Methods(http.MethodGet)
+	r.HandleFunc("/api/folders/{folderUUID}", h.HandleFolderRename).Methods(http.MethodPut)
+	r.HandleFunc("/api/folders/{folderUUID}", h.HandleFolderDelete).Methods(http.MethodDelete)
+	r.HandleFunc("/api/ciphers/{cipherId}/attachment", h.HandleAddAttachment).Methods(http.MethodPost)
+	r.HandleFunc("/api/ciphers/{cipherId}/attachment/{attachmentId}", h.HandleAttachmentInfo).Methods(http.MethodGet)
+	r.HandleFunc("/api/ciphers/{cipherId}/attachment/{attachmentId}", h.HandleDeleteAttachment).Methods(http.MethodDelete)
+	r.HandleFunc("/attachments/{cipherId}/{attachmentId}", h.HandleGetAttachment).Methods(http.MethodGet)
+
+	var upload bytes.Buffer
+	mw := multipart.NewWriter(&upload)
+	fw, _ := mw.CreateFormFile("data", "2.upload")
+	fw.Write([]byte("upload"))
+	mw.Close()
+
+	// A token Alice could get for her own account doesn't open Bob's attachment.
+	token, err := h.attachmentToken(alice.Id, cipher.Id, attachment.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		method      string
+		target      string
+		body        io.Reader
+		contentType string
+		code        int
+	}{
+		{http.MethodGet, "/api/folders/" + folder.Id, nil, "", http.StatusNotFound},
+		{http.MethodGet, "/api/ciphers/" + cipher.Id, nil, "", http.StatusNotFound},
+		{http.MethodGet, "/api/ciphers/" + cipher.Id + "/details", nil, "", http.StatusNotFound},
+		{http.MethodPut, "/api/ciphers/" + cipher.Id + "/partial", strings.NewReader(`{"folderId": null, "favorite": true}`), "", http.StatusNotFound},
+		{http.MethodPut, "/api/ciphers/" + own.Id + "/partial", strings.NewReader(`{"folderId": "` + folder.Id + `", "favorite": true}`), "", http.StatusBadRequest},
+		{http.MethodPut, "/api/folders/" + folder.Id, strings.NewReader(`{"name": "` + testEncString + `"}`), "", http.StatusNotFound},
+		{http.MethodDelete, "/api/folders/" + folder.Id, nil, "", http.StatusNotFound},
+		{http.MethodPut, "/api/ciphers/" + cipher.Id, strings.NewReader(`{"type": 2, "name": "` + testEncString + `"}`), "", http.StatusNotFound},
+		{http.MethodPut, "/api/ciphers/" + own.Id, strings.NewReader(`{"type": 2, "name": "` + testEncString + `", "folderId": "` + folder.Id + `"}`), "", http.StatusBadRequest},
+		{http.MethodPut, "/api/ciphers/" + own.Id, strings.NewReader(`{"type": 2, "name": "` + testEncString + `", "folderId": "missing"}`), "", http.StatusBadRequest},
+		{http.MethodPost, "/api/ciphers", strings.NewReader(`{"type": 2, "name": "` + testEncString + `", "folderId": "` + folder.Id + `"}`), "", http.StatusBadRequest},
+		{http.MethodDelete, "/api/ciphers/" + cipher.Id, nil, "", http.StatusNotFound},
+		{http.MethodPost, "/api/ciphers/" + cipher.Id + "/attachment", bytes.NewReader(upload.Bytes()), mw.FormDataContentType(), http.StatusNotFound},
+		{http.MethodGet, "/api/ciphers/" + cipher.Id + "/attachment/" + attachment.Id, nil, "", http.StatusNotFound},
+		{http.MethodDelete, "/api/ciphers/" + cipher.Id + "/attachment/" + attachment.Id, nil, "", http.StatusNotFound},
+		{http.MethodGet, "/attachments/" + cipher.Id + "/" + attachment.Id + "?token=" + token, nil, "", http.StatusNotFound},
+		{http.MethodPut, "/api/ciphers/move", strings.NewReader(`{"ids": ["` + own.Id + `"], "folderId": "` + folder.Id + `"}`), "", http.StatusBadRequest},
+		// Foreign ids are skipped.
+		{http.MethodPut, "/api/ciphers/move", strings.NewReader(`{"ids": ["` + cipher.Id + `"], "folderId": null}`), "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(c.method, c.target, c.body)
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "email", alice.Email))
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%v %v: response code is %v, want %v", c.method, c.target, w.Code, c.code)
+		}
+	}
+
+	ownCiphers, err := db.GetCiphers(alice.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ownCiphers) != 1 || ownCiphers[0].FolderId != "" {
+		t.Errorf("Alice's ciphers were put in Bob's folder: %+v", ownCiphers)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/sync", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "email", alice.Email))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), cipher.Id) || strings.Contains(w.Body.String(), folder.Id) {
+		t.Error("Alice's sync contains Bob's vault")
+	}
+
+	// Bob's vault is untouched.
+	ciphers, err := db.GetCiphers(bob.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphers) != 1 || ciphers[0].Name != "2.note" || ciphers[0].FolderId != folder.Id || ciphers[0].Favorite || len(ciphers[0].Attachments) != 1 {
+		t.Errorf("Bob's ciphers changed: %+v", ciphers)
+	}
+
+	folders, err := db.GetFolders(bob.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 1 || folders[0].Name != "2.folder" {
+		t.Errorf("Bob's folders changed: %+v", folders)
+	}
+
+	blob, err := h.blobs.Get(attachmentKey(cipher.Id, attachment.Id))
+	if err != nil {
+		t.Fatalf("Bob's attachment blob is gone: %v", err)
+	}
+	blob.Close()
+}
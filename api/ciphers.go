@@ -1,18 +1,19 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"io"
+	"mime"
 	"net/http"
-	"os"
-	"regexp"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	"github.com/404cn/gowarden/ds"
+	"github.com/404cn/gowarden/storage"
 )
 
 func (apiHandler *APIHandler) HandleCiphers(w http.ResponseWriter, r *http.Request) {
@@ -21,36 +22,39 @@ func (apiHandler *APIHandler) HandleCiphers(w http.ResponseWriter, r *http.Reque
 
 	acc, err := apiHandler.db.GetAccount(email)
 	if nil != err {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	var cipher ds.Cipher
-	err = json.NewDecoder(r.Body).Decode(&cipher)
+	err = decodeJSON(r, &cipher)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	validateCipher(&v, "", cipher)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	if err = apiHandler.checkFolder(acc.Id, cipher.FolderId); err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
-	defer r.Body.Close()
 
 	resCipher, err := apiHandler.db.AddCipher(cipher, acc.Id)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	var b []byte
 	b, err = json.Marshal(&resCipher)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
@@ -64,9 +68,7 @@ func (apiHandler *APIHandler) HandleUpdateCiphers(w http.ResponseWriter, r *http
 
 	acc, err := apiHandler.db.GetAccount(email)
 	if nil != err {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
@@ -77,35 +79,58 @@ func (apiHandler *APIHandler) HandleUpdateCiphers(w http.ResponseWriter, r *http
 	// TODO
 	var cipherForUpdate ds.CipherForUpdate
 
-	err = json.NewDecoder(r.Body).Decode(&cipherForUpdate)
+	err = decodeJSON(r, &cipherForUpdate)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
-	defer r.Body.Close()
 
 	// TODO
 	cipher.Type, cipher.FolderId, cipher.OrganizationId = cipherForUpdate.Type, cipherForUpdate.FolderId, cipherForUpdate.OrganizationId
 	cipher.Name, cipher.Notes, cipher.Favorite = cipherForUpdate.Name, cipherForUpdate.Notes, cipherForUpdate.Favorite
-	cipher.Login, cipher.Fields = cipherForUpdate.Login, cipherForUpdate.Fields
+	cipher.Login, cipher.Fields, cipher.PasswordHistory = cipherForUpdate.Login, cipherForUpdate.Fields, cipherForUpdate.PasswordHistory
 	cipher.Card, cipher.Identity, cipher.SecureNote = cipherForUpdate.Card, cipherForUpdate.Identity, cipherForUpdate.SecureNote
+	cipher.Extra = cipherForUpdate.Extra
+
+	var v validator
+	validateCipher(&v, "", cipher)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
 
+	if err = apiHandler.checkFolder(acc.Id, cipher.FolderId); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	// Refuse to overwrite changes the client hasn't seen.
 	cipher.Id = cipherId
-	cipher, err = apiHandler.db.UpdateCipher(cipher, acc.Id)
+	last := cipherForUpdate.LastKnownRevisionDate
+	cipher, err = apiHandler.db.UpdateCipher(cipher, acc.Id, last)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Cipher doesn't exist.")
+		return
+	}
+	if err == ds.ErrOutOfDate {
+		apiHandler.logger.Infof("cipher %v changed since %v, refusing update.", cipherId, last)
+		writeError(w, http.StatusBadRequest, "The client copy of this cipher is out of date. Resync the client and try again.")
+		return
+	}
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	err = apiHandler.signAttachments(r, acc.Id, []ds.Cipher{cipher})
+	if err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	d, err := json.Marshal(&cipher)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -115,29 +140,258 @@ func (apiHandler *APIHandler) HandleUpdateCiphers(w http.ResponseWriter, r *http
 	return
 }
 
+// list the ciphers of an account
+func (apiHandler *APIHandler) HandleGetCiphers(w http.ResponseWriter, r *http.Request) {
+	email := getEmailRctx(r)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	ciphers, err := apiHandler.db.GetCiphers(acc.Id)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+	if ciphers == nil {
+		ciphers = make([]ds.Cipher, 0)
+	}
+
+	err = apiHandler.signAttachments(r, acc.Id, ciphers)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	data := struct {
+		Data   interface{}
+		Object string
+	}{
+		Data:   ciphers,
+		Object: "list",
+	}
+
+	d, err := json.Marshal(&data)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
+
+// Get a single cipher, also used for its details.
+func (apiHandler *APIHandler) HandleGetCipher(w http.ResponseWriter, r *http.Request) {
+	email := getEmailRctx(r)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	cipher, err := apiHandler.db.GetCipher(acc.Id, mux.Vars(r)["cipherId"])
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Cipher doesn't exist.")
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.writeCipher(w, r, acc.Id, cipher)
+}
+
+// Change only the folder and favorite flag of a cipher, the content stays as it is.
+func (apiHandler *APIHandler) HandlePartialUpdateCipher(w http.ResponseWriter, r *http.Request) {
+	var rpartial struct {
+		FolderId string `json:"folderId"`
+		Favorite bool   `json:"favorite"`
+	}
+
+	err := decodeJSON(r, &rpartial)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+	cipherId := mux.Vars(r)["cipherId"]
+	apiHandler.logger.Infof("%v is trying to partially update cipher %v.", email, cipherId)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	if err = apiHandler.checkFolder(acc.Id, rpartial.FolderId); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	cipher, err := apiHandler.db.UpdateCipherPartial(acc.Id, cipherId, rpartial.FolderId, rpartial.Favorite)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Cipher doesn't exist.")
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.writeCipher(w, r, acc.Id, cipher)
+}
+
+// writeCipher answers with a cipher of the account, its attachments signed.
+func (apiHandler *APIHandler) writeCipher(w http.ResponseWriter, r *http.Request, accId string, cipher ds.Cipher) {
+	err := apiHandler.signAttachments(r, accId, []ds.Cipher{cipher})
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	d, err := json.Marshal(&cipher)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
+
+// Move ciphers into a folder, or out of any folder.
+func (apiHandler *APIHandler) HandleMoveCiphers(w http.ResponseWriter, r *http.Request) {
+	var rmove struct {
+		Ids      []string `json:"ids"`
+		FolderId string   `json:"folderId"`
+	}
+
+	err := decodeJSON(r, &rmove)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+	apiHandler.logger.Infof("%v is trying to move %v ciphers.", email, len(rmove.Ids))
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	if err = apiHandler.checkFolder(acc.Id, rmove.FolderId); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	err = apiHandler.db.MoveCiphers(acc.Id, rmove.FolderId, rmove.Ids)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+}
+
+// Import ciphers and folders exported from another password manager. The
+// client decrypts and re-encrypts everything, ciphers keep their password history.
+func (apiHandler *APIHandler) HandleImportCiphers(w http.ResponseWriter, r *http.Request) {
+	var rimport struct {
+		Ciphers []ds.Cipher `json:"ciphers"`
+		Folders []struct {
+			Name string `json:"name"`
+		} `json:"folders"`
+		// Key is the index of a cipher, value the index of its folder.
+		FolderRelationships []struct {
+			Key   int `json:"key"`
+			Value int `json:"value"`
+		} `json:"folderRelationships"`
+	}
+
+	err := decodeJSON(r, &rimport)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	for i, folder := range rimport.Folders {
+		v.encString("Folders["+strconv.Itoa(i)+"].Name", folder.Name, maxEncStringLength, true)
+	}
+	for i, cipher := range rimport.Ciphers {
+		validateCipher(&v, "Ciphers["+strconv.Itoa(i)+"].", cipher)
+	}
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+	apiHandler.logger.Infof("%v is trying to import %v ciphers.", email, len(rimport.Ciphers))
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	folders := make([]ds.Folder, len(rimport.Folders))
+	for i, folder := range rimport.Folders {
+		folders[i] = ds.Folder{
+			Id:     uuid.Must(uuid.NewRandom()).String(),
+			Name:   folder.Name,
+			Object: "folder",
+		}
+	}
+
+	// Imported ciphers only go into imported folders.
+	for i := range rimport.Ciphers {
+		rimport.Ciphers[i].FolderId = ""
+	}
+	for _, rel := range rimport.FolderRelationships {
+		if rel.Key < 0 || rel.Key >= len(rimport.Ciphers) || rel.Value < 0 || rel.Value >= len(folders) {
+			writeError(w, http.StatusBadRequest, "Invalid folder relationship.")
+			return
+		}
+		rimport.Ciphers[rel.Key].FolderId = folders[rel.Value].Id
+	}
+
+	err = apiHandler.db.ImportCiphers(acc.Id, folders, rimport.Ciphers)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+}
+
 func (apiHandler *APIHandler) HandleDeleteCiphers(w http.ResponseWriter, r *http.Request) {
 	email := getEmailRctx(r)
 	apiHandler.logger.Infof("%v is trying to delete cipher.", email)
 
 	acc, err := apiHandler.db.GetAccount(email)
 	if nil != err {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	cipherId := mux.Vars(r)["cipherId"]
 
 	err = apiHandler.db.DeleteCipher(acc.Id, cipherId)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Cipher doesn't exist.")
+		return
+	}
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
-	err = os.RemoveAll("attachments/" + cipherId)
+	err = apiHandler.blobs.DeleteAll(cipherId)
 	if err != nil {
 		apiHandler.logger.Error(err)
 	}
@@ -147,6 +401,49 @@ func (apiHandler *APIHandler) HandleDeleteCiphers(w http.ResponseWriter, r *http
 	return
 }
 
+// Delete every folder, cipher and attachment of the account, the account stays.
+func (apiHandler *APIHandler) HandlePurgeCiphers(w http.ResponseWriter, r *http.Request) {
+	acc, err := apiHandler.verifyMasterPassword(r)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	apiHandler.logger.Infof("%v is trying to purge the vault.", acc.Email)
+
+	cipherIds, err := apiHandler.db.PurgeVault(acc.Id)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+	apiHandler.deleteAttachmentBlobs(cipherIds)
+
+	apiHandler.logger.Infof("Vault of %v purged.", acc.Email)
+}
+
+// deleteAttachmentBlobs removes the attachment files of deleted ciphers. The
+// ciphers are gone already, so failures are only logged.
+func (apiHandler *APIHandler) deleteAttachmentBlobs(cipherIds []string) {
+	for _, cipherId := range cipherIds {
+		if err := apiHandler.blobs.DeleteAll(cipherId); err != nil {
+			apiHandler.logger.Error(err)
+		}
+	}
+}
+
+// checkFolder makes sure folderId is a folder of the account, no folder is fine too.
+func (apiHandler *APIHandler) checkFolder(accId, folderId string) error {
+	if folderId == "" {
+		return nil
+	}
+
+	_, err := apiHandler.db.GetFolder(accId, folderId)
+	if err == sql.ErrNoRows {
+		return badRequest("Folder not found.")
+	}
+	return err
+}
+
 func (apiHandler APIHandler) HandleAddAttachment(w http.ResponseWriter, r *http.Request) {
 	var attachment ds.Attachment
 	email := getEmailRctx(r)
@@ -154,55 +451,109 @@ func (apiHandler APIHandler) HandleAddAttachment(w http.ResponseWriter, r *http.
 
 	attachment.Id = uuid.Must(uuid.NewRandom()).String()
 
-	attachment.Url = strings.ToLower(strings.Split(r.Proto, "/")[0]) + "://" + r.Host + "/attachments/" + cipherId + "/" + attachment.Id
-
 	apiHandler.logger.Infof("%v is trying to add attachment.", email)
 
-	parseErr := r.ParseMultipartForm(0)
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	// Check the cipher before receiving the upload.
+	_, err = apiHandler.db.GetCipher(acc.Id, cipherId)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Cipher doesn't exist.")
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var body *limitedBody
+	if apiHandler.maxAttachmentSize > 0 {
+		// Leave some room for the multipart envelope and the key field.
+		limit := apiHandler.maxAttachmentSize + multipartOverhead
+		body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), limit: limit}
+		r.Body = body
+	}
+
+	parseErr := r.ParseMultipartForm(multipartMemory)
+	if body != nil && body.exceeded() {
+		writeError(w, http.StatusRequestEntityTooLarge, "Max file size is "+sizeName(apiHandler.maxAttachmentSize)+".")
+		return
+	}
 	if parseErr != nil {
-		apiHandler.logger.Error(parseErr)
-		http.Error(w, "failed to parse multipart message", http.StatusBadRequest)
+		apiHandler.handleError(w, &Error{Status: http.StatusBadRequest, Message: "Failed to parse the attachment.", Err: parseErr})
 		return
 	}
+	defer r.MultipartForm.RemoveAll()
 
-	attachment.Key = r.FormValue("key")
+	files := r.MultipartForm.File["data"]
+	if len(files) != 1 {
+		writeError(w, http.StatusBadRequest, "Exactly one file must be sent as data.")
+		return
+	}
+	h := files[0]
 
-	for _, h := range r.MultipartForm.File["data"] {
-		attachment.FileName = h.Filename
-		attachment.Size = strconv.FormatInt(h.Size, 10)
+	if apiHandler.maxAttachmentSize > 0 && h.Size > apiHandler.maxAttachmentSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "Max file size is "+sizeName(apiHandler.maxAttachmentSize)+".")
+		return
+	}
 
-		file, _ := h.Open()
+	// Uploads of an account run one at a time from checking the quota to
+	// saving the attachment, or together they could exceed it.
+	unlock := apiHandler.uploadLocks.lock(acc.Id)
+	defer unlock()
 
-		_, err := os.Stat("attachments/" + cipherId)
+	if apiHandler.storageQuota > 0 {
+		used, err := apiHandler.db.GetStorageUsage(acc.Id)
 		if err != nil {
-			apiHandler.logger.Info("Didn't find attachments's folder, try to create.")
-			os.Mkdir("attachments/"+cipherId, os.ModePerm)
+			apiHandler.handleError(w, err)
+			return
 		}
 
-		tmpfile, err := os.Create(regexp.MustCompile(`attachments.*`).FindStringSubmatch(attachment.Url)[0])
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		if used+h.Size > apiHandler.storageQuota {
+			apiHandler.logger.Infof("%v is out of storage, used %v of %v.", email, used, apiHandler.storageQuota)
+			writeError(w, http.StatusBadRequest, "Not enough storage available.")
 			return
 		}
-		defer tmpfile.Close()
-		io.Copy(tmpfile, file)
 	}
 
-	cipher, err := apiHandler.db.AddAttachment(cipherId, attachment)
+	attachment.Key = r.FormValue("key")
+	attachment.FileName = h.Filename
+	attachment.Size = strconv.FormatInt(h.Size, 10)
+
+	file, err := h.Open()
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	err = apiHandler.blobs.Put(attachmentKey(cipherId, attachment.Id), file, h.Size)
+	file.Close()
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	cipher, err := apiHandler.db.AddAttachment(acc.Id, cipherId, attachment)
+	if err != nil {
+		// Don't leave an orphan blob behind.
+		apiHandler.blobs.Delete(attachmentKey(cipherId, attachment.Id))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	err = apiHandler.signAttachments(r, acc.Id, []ds.Cipher{cipher})
+	if err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	d, err := json.Marshal(&cipher)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
@@ -218,15 +569,23 @@ func (apiHandler APIHandler) HandleDeleteAttachment(w http.ResponseWriter, r *ht
 
 	apiHandler.logger.Infof("%v is trying to delete attachment.", email)
 
-	url, err := apiHandler.db.DeleteAttachment(cipherId, attachmentId)
+	acc, err := apiHandler.db.GetAccount(email)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	_, err = apiHandler.db.DeleteAttachment(acc.Id, cipherId, attachmentId)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Attachment doesn't exist.")
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
 
-	err = os.Remove(regexp.MustCompile(`attachments.*`).FindStringSubmatch(url)[0])
+	err = apiHandler.blobs.Delete(attachmentKey(cipherId, attachmentId))
 	if err != nil {
 		apiHandler.logger.Error(err)
 	}
@@ -234,20 +593,84 @@ func (apiHandler APIHandler) HandleDeleteAttachment(w http.ResponseWriter, r *ht
 	return
 }
 
+// Download an attachment, the url must carry a token from attachmentUrl.
 func (apiHandler APIHandler) HandleGetAttachment(w http.ResponseWriter, r *http.Request) {
 	cipherId := mux.Vars(r)["cipherId"]
 	attachmentId := mux.Vars(r)["attachmentId"]
 
 	apiHandler.logger.Infof("trying to download attachment: %v.", attachmentId)
 
-	attachment, err := apiHandler.db.GetAttachment(cipherId, attachmentId)
+	accId, err := apiHandler.checkAttachmentToken(r.URL.Query().Get("token"), cipherId, attachmentId)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, &Error{Status: http.StatusUnauthorized, Message: "The attachment token is invalid.", Err: err})
+		return
+	}
+
+	attachment, err := apiHandler.db.GetAttachment(accId, cipherId, attachmentId)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Attachment doesn't exist.")
 		return
 	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	key := attachmentKey(cipherId, attachmentId)
+
+	// Let clients download straight from the store if it can sign urls.
+	url, err := apiHandler.blobs.SignedURL(key, attachmentUrlExpiresin*time.Second)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+	if url != "" {
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	blob, err := apiHandler.blobs.Get(key)
+	if err == storage.ErrNotExist {
+		apiHandler.handleError(w, &Error{Status: http.StatusNotFound, Message: "Attachment doesn't exist.", Err: err})
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+
+	// ServeContent answers range requests and sets Content-Length for us.
+	if rs, ok := blob.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, rs)
+		return
+	}
+
+	w.Header().Set("Content-Length", attachment.Size)
+	_, err = io.Copy(w, blob)
+	if err != nil {
+		apiHandler.logger.Error(err)
+	}
+}
+
+// sizeName formats size the way bitwarden shows attachment sizes.
+func sizeName(size int64) string {
+	switch {
+	case size >= 1<<30:
+		return strconv.FormatFloat(float64(size)/(1<<30), 'f', 1, 64) + " GB"
+	case size >= 1<<20:
+		return strconv.FormatFloat(float64(size)/(1<<20), 'f', 1, 64) + " MB"
+	case size >= 1<<10:
+		return strconv.FormatInt(size>>10, 10) + " KB"
+	default:
+		return strconv.FormatInt(size, 10) + " Bytes"
+	}
+}
 
-	// TODO doesn't work
-	http.ServeFile(w, r, regexp.MustCompile(`attachment.*`).FindStringSubmatch(attachment.Url)[0])
+// attachmentKey returns the blob key attachmentId of cipherId is stored under.
+func attachmentKey(cipherId, attachmentId string) string {
+	return cipherId + "/" + attachmentId
 }
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/404cn/gowarden/sqlite/mock"
+	"github.com/gorilla/mux"
+)
+
+func updateCipher(t *testing.T, lastKnownRevisionDate string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/ciphers/{cipherId}", testHandler.HandleUpdateCiphers)
+
+	body := `{"type": 2, "name": "` + testEncString + `", "secureNote": {"type": 0}`
+	if lastKnownRevisionDate != "" {
+		body += `, "lastKnownRevisionDate": ` + lastKnownRevisionDate
+	}
+	body += "}"
+
+	req := withEmail(httptest.NewRequest(http.MethodPut, "/api/ciphers/cipher", strings.NewReader(body)))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandleUpdateCiphersOutOfDate(t *testing.T) {
+	stored := mock.RevisionDate.UTC()
+
+	for _, c := range []struct {
+		name                  string
+		lastKnownRevisionDate string
+		code                  int
+	}{
+		{"without revision date", "", http.StatusOK},
+		{"null revision date", "null", http.StatusOK},
+		{"same revision", `"` + stored.Format(time.RFC3339) + `"`, http.StatusOK},
+		{"same second", `"` + stored.Add(500*time.Millisecond).Format(time.RFC3339Nano) + `"`, http.StatusOK},
+		{"newer revision", `"` + stored.Add(time.Hour).Format(time.RFC3339) + `"`, http.StatusOK},
+		{"older revision", `"` + stored.Add(-time.Second).Format(time.RFC3339) + `"`, http.StatusBadRequest},
+	} {
+		w := updateCipher(t, c.lastKnownRevisionDate)
+		if w.Code != c.code {
+			t.Errorf("%s: response code is %v, want %v", c.name, w.Code, c.code)
+			continue
+		}
+
+		if c.code == http.StatusBadRequest {
+			var res errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(res.Message, "The client copy of this cipher is out of date") {
+				t.Errorf("%s: unexpected error %q", c.name, res.Message)
+			}
+		}
+	}
+}
+
+func TestUnknownCipherType(t *testing.T) {
+	db, h := newSqliteHandler(t)
+	register(t, h, "nobody@example.com", "b2xk")
+
+	sshKey := `{"privateKey":"` + testEncString + `","publicKey":"` + testEncString + `","keyFingerprint":"` + testEncString + `"}`
+	w := httptest.NewRecorder()
+	h.HandleCiphers(w, withEmail(httptest.NewRequest(http.MethodPost, "/api/ciphers", strings.NewReader(`{"type": 5, "name": "`+testEncString+`", "sshKey": `+sshKey+`}`))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Response code is %v: %v", w.Code, w.Body)
+	}
+
+	acc, err := db.GetAccount("nobody@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphers, err := db.GetCiphers(acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphers) != 1 || ciphers[0].Type != 5 || string(ciphers[0].Extra["sshKey"]) != sshKey {
+		t.Errorf("Stored ciphers are %+v", ciphers)
+	}
+}
+
+func TestSizeName(t *testing.T) {
+	for size, want := range map[int64]string{
+		0:         "0 Bytes",
+		512:       "512 Bytes",
+		1023:      "1023 Bytes",
+		1024:      "1 KB",
+		100 << 20: "100.0 MB",
+		3 << 29:   "1.5 GB",
+	} {
+		if got := sizeName(size); got != want {
+			t.Errorf("sizeName(%v) = %q, want %q", size, got, want)
+		}
+	}
+}
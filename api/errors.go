@@ -0,0 +1,136 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// errorResponse is the error body bitwarden clients know how to show to users.
+type errorResponse struct {
+	Message          string
+	ValidationErrors map[string][]string
+	Object           string
+}
+
+// Error is an error handlers answer with its status code and message, the
+// wrapped Err is only logged.
+type Error struct {
+	Status  int
+	Message string
+	// Messages per request field, for requests that failed validation.
+	ValidationErrors map[string][]string
+	Err              error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(message string) *Error {
+	return &Error{Status: http.StatusBadRequest, Message: message}
+}
+
+func notFound(message string) *Error {
+	return &Error{Status: http.StatusNotFound, Message: message}
+}
+
+// validationError is a 400 for a request field with an invalid value, more
+// fields can be added with Add.
+func validationError(field, message string) *Error {
+	e := &Error{Status: http.StatusBadRequest, Message: "The model state is invalid."}
+	return e.Add(field, message)
+}
+
+func (e *Error) Add(field, message string) *Error {
+	if e.ValidationErrors == nil {
+		e.ValidationErrors = make(map[string][]string)
+	}
+	e.ValidationErrors[field] = append(e.ValidationErrors[field], message)
+	return e
+}
+
+// decodeJSON decodes the request body into v, a malformed body is a 400.
+func decodeJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return &Error{Status: http.StatusBadRequest, Message: "The request body is not valid json.", Err: err}
+	}
+	return nil
+}
+
+// handleError answers a request that failed with err. An *Error is answered
+// as it says, sql.ErrNoRows with 404, and anything else with 500 without
+// telling the client more.
+func (apiHandler *APIHandler) handleError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *Error:
+		if e.Err != nil || e.Status >= http.StatusInternalServerError {
+			apiHandler.logger.Error(e)
+		}
+		writeErrorResponse(w, e.Status, errorResponse{
+			Message:          e.Message,
+			ValidationErrors: e.ValidationErrors,
+			Object:           "error",
+		})
+	default:
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Resource not found.")
+			return
+		}
+		apiHandler.logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "An error has occurred.")
+	}
+}
+
+// handleTokenError answers a token request that failed with an unexpected err.
+func (apiHandler *APIHandler) handleTokenError(w http.ResponseWriter, err error) {
+	apiHandler.logger.Error(err)
+	writeTokenError(w, http.StatusInternalServerError, "server_error", "An error has occurred.")
+}
+
+// writeError writes message in bitwarden's error format with status code.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeErrorResponse(w, status, errorResponse{Message: message, Object: "error"})
+}
+
+// writeErrorResponse writes res, a message without field errors is also
+// given as the error of the empty field like bitwarden does.
+func writeErrorResponse(w http.ResponseWriter, status int, res errorResponse) {
+	if res.ValidationErrors == nil {
+		res.ValidationErrors = map[string][]string{"": {res.Message}}
+	}
+	d, _ := json.Marshal(&res)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(d)
+}
+
+// writeTokenError answers the token endpoint in the OAuth format, code is one
+// of the error codes of RFC 6749 like invalid_grant.
+func writeTokenError(w http.ResponseWriter, status int, code, description string) {
+	d, _ := json.Marshal(&struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+		ErrorModel       errorResponse
+	}{
+		Error:            code,
+		ErrorDescription: description,
+		ErrorModel:       errorResponse{Message: description, Object: "error"},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(d)
+}
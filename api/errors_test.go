@@ -0,0 +1,87 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleError(t *testing.T) {
+	for _, c := range []struct {
+		name             string
+		err              error
+		code             int
+		message          string
+		validationErrors map[string][]string
+	}{
+		{"no rows", sql.ErrNoRows, http.StatusNotFound, "Resource not found.", map[string][]string{"": {"Resource not found."}}},
+		{"internal", errors.New("disk on fire"), http.StatusInternalServerError, "An error has occurred.", map[string][]string{"": {"An error has occurred."}}},
+		{"bad request", badRequest("Nope."), http.StatusBadRequest, "Nope.", map[string][]string{"": {"Nope."}}},
+		{"validation", validationError("Name", "The Name field is required.").Add("Type", "Unknown type."), http.StatusBadRequest, "The model state is invalid.",
+			map[string][]string{"Name": {"The Name field is required."}, "Type": {"Unknown type."}}},
+	} {
+		w := httptest.NewRecorder()
+		testHandler.handleError(w, c.err)
+
+		if w.Code != c.code {
+			t.Errorf("%v: response code is %v, want %v", c.name, w.Code, c.code)
+		}
+
+		var res errorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if res.Message != c.message || res.Object != "error" {
+			t.Errorf("%v: got %+v", c.name, res)
+		}
+		for field, messages := range c.validationErrors {
+			if strings.Join(res.ValidationErrors[field], "|") != strings.Join(messages, "|") {
+				t.Errorf("%v: field %q has errors %v, want %v", c.name, field, res.ValidationErrors[field], messages)
+			}
+		}
+		if strings.Contains(w.Body.String(), "disk on fire") {
+			t.Errorf("%v: internal error leaked to the client", c.name)
+		}
+	}
+}
+
+func TestMalformedBody(t *testing.T) {
+	req := withEmail(httptest.NewRequest(http.MethodPost, "/api/folders", strings.NewReader(`{"name": `)))
+	w := httptest.NewRecorder()
+	testHandler.HandleFolder(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Response code is %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTokenErrors(t *testing.T) {
+	for _, c := range []struct {
+		form string
+		code string
+	}{
+		{"", "invalid_request"},
+		{"grant_type=client_credentials", "unsupported_grant_type"},
+		{"grant_type=refresh_token&refresh_token=short", "invalid_grant"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/identity/connect/token", strings.NewReader(c.form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		testHandler.HandleLogin(w, req)
+
+		var res struct {
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%q: %v", c.form, err)
+		}
+		if w.Code != http.StatusBadRequest || res.Error != c.code || res.ErrorDescription == "" {
+			t.Errorf("%q: got %v %+v, want 400 %v", c.form, w.Code, res, c.code)
+		}
+	}
+}
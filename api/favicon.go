@@ -1,133 +1,46 @@
 package api
 
 import (
-	"crypto/tls"
-	"encoding/json"
-	"github.com/gorilla/mux"
-	"io"
-	"io/ioutil"
+	"bytes"
 	"net/http"
-	"net/url"
-	"os"
+	"strconv"
+
+	"github.com/404cn/gowarden/favicon"
+	"github.com/gorilla/mux"
 )
 
-const iconsDir = "icons"
-const faviconApi = "https://iconbin.com/api/"
+// How long clients may cache an icon.
+const iconMaxAge = 7 * 24 * 3600
 
 func (apiHandler APIHandler) HandleFavicon(w http.ResponseWriter, r *http.Request) {
 	domain := mux.Vars(r)["domain"]
-	icon := mux.Vars(r)["icon"]
-	iconFile := iconsDir + "/" + domain + "." + icon
-
-	_, err := os.Stat(iconFile)
-	if err != nil {
-		apiHandler.logger.Info("Didn't find icon, try to download.")
-		proxyUrl, err := url.Parse(apiHandler.proxyServer)
-		if err != nil {
-			apiHandler.logger.Error(err)
-			return
-		}
-		t := &http.Transport{
-			Proxy:           http.ProxyURL(proxyUrl),
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		// TODO rewrite with http.Get
-		client := http.Client{
-			Transport: t,
-		}
-		url := faviconApi + domain
-
-		apiHandler.logger.Info("Try to access : " + url)
-
-		req, err := http.NewRequest(http.MethodGet, url, nil)
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
-		}
-
-		res, err := client.Do(req)
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
-		}
-
-		body, _ := ioutil.ReadAll(res.Body)
-		defer func() { _ = res.Body.Close() }()
-
-		var foo struct {
-			W             int    `json:w`
-			H             int    `json:h`
-			Content_type  string `json:content_type`
-			Canonical_url string `json:canonical_url`
-			Src           string `json:src`
-		}
-
-		err = json.Unmarshal(body, &foo)
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
-		}
-
-		//--------------------------------------------------------------------
 
-		req, err = http.NewRequest(http.MethodGet, foo.Src, nil)
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
-		}
-
-		res, err = client.Do(req)
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
-		}
-
-		f, err := os.Create(iconFile)
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
-		}
-		defer func() { _ = f.Close() }()
-
-		_, err = io.Copy(f, res.Body)
-
-		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
-			return
-		}
+	if !favicon.ValidDomain(domain) {
+		apiHandler.logger.Errorf("Invalid icon domain: %v", domain)
+		writeError(w, http.StatusBadRequest, "Invalid domain.")
+		return
 	}
 
-	f, err := os.Open(iconFile)
-	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+	icon, err := apiHandler.icons.Icon(domain)
+	if err == favicon.ErrNotFound {
+		apiHandler.logger.Debugf("No icon for %v.", domain)
+		writeError(w, http.StatusNotFound, "No icon found.")
 		return
 	}
-
-	apiHandler.logger.Info("Find icon: " + iconFile)
-
-	_, err = io.Copy(w, f)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
-	return
+	contentType := icon.ContentType
+	if contentType == "" {
+		contentType = "image/png"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(iconMaxAge))
+	w.Header().Set("ETag", icon.ETag)
+
+	// ServeContent sets Last-Modified and answers conditional requests with 304.
+	http.ServeContent(w, r, "", icon.ModTime, bytes.NewReader(icon.Data))
 }
@@ -1,23 +1,96 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 
 	"github.com/gorilla/mux"
 )
 
+// list the folders of an account
+func (apiHandler APIHandler) HandleGetFolders(w http.ResponseWriter, r *http.Request) {
+	email := getEmailRctx(r)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	folders, err := apiHandler.db.GetFolders(acc.Id)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	data := struct {
+		Data   interface{}
+		Object string
+	}{
+		Data:   folders,
+		Object: "list",
+	}
+
+	b, err := json.Marshal(&data)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (apiHandler APIHandler) HandleGetFolder(w http.ResponseWriter, r *http.Request) {
+	folderUUID := mux.Vars(r)["folderUUID"]
+	email := getEmailRctx(r)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	folder, err := apiHandler.db.GetFolder(acc.Id, folderUUID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Folder doesn't exist.")
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	b, err := json.Marshal(&folder)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
 func (apiHandler APIHandler) HandleFolderDelete(w http.ResponseWriter, r *http.Request) {
 	folderUUID := mux.Vars(r)["folderUUID"]
 	email := getEmailRctx(r)
 
 	apiHandler.logger.Infof("%v is trying to delete a folder", email)
 
-	err := apiHandler.db.DeleteFolder(folderUUID)
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	err = apiHandler.db.DeleteFolder(acc.Id, folderUUID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Folder doesn't exist.")
+		return
+	}
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 }
@@ -27,33 +100,43 @@ func (apiHandler APIHandler) HandleFolderRename(w http.ResponseWriter, r *http.R
 		Name string `json:"name"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&rfolder)
+	err := decodeJSON(r, &rfolder)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	v.encString("Name", rfolder.Name, maxEncStringLength, true)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
-	defer r.Body.Close()
 
 	folderUUID := mux.Vars(r)["folderUUID"]
 	email := getEmailRctx(r)
 
 	apiHandler.logger.Infof("%v is trying to rename a folder", email)
 
-	folder, err := apiHandler.db.RenameFolder(rfolder.Name, folderUUID)
+	acc, err := apiHandler.db.GetAccount(email)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	folder, err := apiHandler.db.RenameFolder(acc.Id, rfolder.Name, folderUUID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Folder doesn't exist.")
+		return
+	}
+	if err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	b, err := json.Marshal(&folder)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
@@ -67,37 +150,35 @@ func (apiHandler APIHandler) HandleFolder(w http.ResponseWriter, r *http.Request
 		Name string `json:"name"`
 	}
 
-	err := json.NewDecoder(r.Body).Decode(&rfolder)
+	err := decodeJSON(r, &rfolder)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	v.encString("Name", rfolder.Name, maxEncStringLength, true)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
-	defer r.Body.Close()
 
 	emali := getEmailRctx(r)
 	acc, err := apiHandler.db.GetAccount(emali)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	folder, err := apiHandler.db.AddFolder(acc.Id, rfolder.Name)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	b, err := json.Marshal(&folder)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 	"time"
@@ -13,16 +14,20 @@ func (apiHandler *APIHandler) HandleNegotiate(w http.ResponseWriter, r *http.Req
 
 }
 
-// Update account's keys.
+// Update account's keys, clients upload the key pair once after registering.
+// It is not a key rotation, so other sessions stay logged in.
 func (apiHandler *APIHandler) HandleAccountKeys(w http.ResponseWriter, r *http.Request) {
 	var keys ds.Keys
-	err := json.NewDecoder(r.Body).Decode(&keys)
-	defer r.Body.Close()
+	err := decodeJSON(r, &keys)
 	if nil != err {
-		apiHandler.logger.Error("Failed to decode request body.")
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	validateKeys(&v, keys)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
 
@@ -30,51 +35,43 @@ func (apiHandler *APIHandler) HandleAccountKeys(w http.ResponseWriter, r *http.R
 
 	acc, err := apiHandler.db.GetAccount(email)
 	if nil != err {
-		apiHandler.logger.Errorf("Failed to get account with %v", email)
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
-	acc.Keys = keys
-	apiHandler.db.UpdateAccount(acc)
+	err = apiHandler.db.UpdateKeys(acc.Id, keys)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
 }
 
 func (apiHandler *APIHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	var acc ds.Account
-	decoder := json.NewDecoder(r.Body)
-	defer r.Body.Close()
-	err := decoder.Decode(&acc)
+	err := decodeJSON(r, &acc)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
-	if acc.KdfIterations < 5000 || acc.KdfIterations > 100000 {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+	var v validator
+	validateAccount(&v, acc)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	apiHandler.logger.Info(acc.Email + " is trying to register.")
 
-	acc.MasterPasswordHash, err = makeKey(acc.MasterPasswordHash, acc.Email, acc.KdfIterations)
+	acc.MasterPasswordHash, err = apiHandler.passwordHash.hash(acc.MasterPasswordHash)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(500)))
+		apiHandler.handleError(w, validationError("MasterPasswordHash", "The MasterPasswordHash field is not base64."))
 		return
 	}
 
 	err = apiHandler.db.AddAccount(acc)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(500)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
@@ -88,36 +85,37 @@ func (apiHandler *APIHandler) HandleLogin(w http.ResponseWriter, r *http.Request
 	var err error
 	r.ParseForm()
 
-	grantType, ok := r.PostForm["grant_type"]
-	if !ok {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+	grantType := r.PostForm.Get("grant_type")
+	switch grantType {
+	case "refresh_token", "password":
+	case "":
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", "The grant_type parameter is missing.")
+		return
+	default:
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "The grant type "+grantType+" is not supported.")
 		return
 	}
 
-	if grantType[0] == "refresh_token" {
-		refreshToken := r.PostForm["refresh_token"][0]
+	if grantType == "refresh_token" {
+		refreshToken := r.PostForm.Get("refresh_token")
 		if len(refreshToken) != 32 {
 			// TODO length 44, base64 encoded
-			apiHandler.logger.Errorf("token超时或出现错误， err: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "The refresh token is invalid.")
 			return
 		}
 
 		acc, err := apiHandler.db.GetAccount(refreshToken)
+		if err == sql.ErrNoRows {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "The refresh token is invalid.")
+			return
+		}
 		if nil != err {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			apiHandler.handleTokenError(w, err)
 			return
 		}
 
 		if refreshToken != acc.RefreshToken {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "The refresh token is invalid.")
 			return
 		}
 
@@ -125,15 +123,17 @@ func (apiHandler *APIHandler) HandleLogin(w http.ResponseWriter, r *http.Request
 
 	} else {
 		// login in with email.
-		email := r.PostForm["username"][0]
-		password := r.PostForm["password"][0]
+		email := r.PostForm.Get("username")
+		password := r.PostForm.Get("password")
 
 		apiHandler.logger.Info(email + " is trying to login.")
-		acc, err = checkPassword(email, password, apiHandler.db)
+		acc, err = apiHandler.checkPassword(email, password)
+		if err == sql.ErrNoRows || err == errWrongPassword {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Username or password is incorrect. Try again.")
+			return
+		}
 		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			apiHandler.handleTokenError(w, err)
 			return
 		}
 
@@ -142,11 +142,9 @@ func (apiHandler *APIHandler) HandleLogin(w http.ResponseWriter, r *http.Request
 	// If accounts refresh token is not empty, do not change it or the other clients will be logged out.
 	if "" == acc.RefreshToken {
 		acc.RefreshToken = createRefreshToken()
-		err = apiHandler.db.UpdateAccount(acc)
+		err = apiHandler.db.UpdateRefreshToken(acc.Id, acc.RefreshToken)
 		if err != nil {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			apiHandler.handleTokenError(w, err)
 			return
 		}
 	}
@@ -159,13 +157,12 @@ func (apiHandler *APIHandler) HandleLogin(w http.ResponseWriter, r *http.Request
 		"sub":     "gowarden",
 		"email":   acc.Email,
 		"name":    acc.Name,
-		"premium": true,
+		"premium": acc.Premium(),
+		"sstamp":  acc.SecurityStamp,
 	})
 	accessToken, err := token.SignedString([]byte(apiHandler.signingKey))
 	if nil != err {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleTokenError(w, err)
 		return
 	}
 
@@ -175,19 +172,19 @@ func (apiHandler *APIHandler) HandleLogin(w http.ResponseWriter, r *http.Request
 		TokenType    string `json:"token_type"`
 		RefreshToken string `json:"refresh_token"`
 		Key          string `json:"Key"`
+		kdfParams
 	}{
 		AccessToken:  accessToken,
 		ExpiresIn:    jwtExpiresin,
 		TokenType:    "Bearer",
 		RefreshToken: acc.RefreshToken,
 		Key:          acc.Key,
+		kdfParams:    accountKdf(acc),
 	}
 
 	d, err := json.Marshal(&rtoken)
 	if nil != err {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+		apiHandler.handleTokenError(w, err)
 		return
 	}
 
@@ -199,38 +196,26 @@ func (apiHandler *APIHandler) HandleLogin(w http.ResponseWriter, r *http.Request
 func (apiHandler *APIHandler) HandlePrelogin(w http.ResponseWriter, r *http.Request) {
 	var acc ds.Account
 
-	decoder := json.NewDecoder(r.Body)
-	defer r.Body.Close()
-	err := decoder.Decode(&acc)
+	err := decodeJSON(r, &acc)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
 	acc, err = apiHandler.db.GetAccount(acc.Email)
-	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(500)))
+	if err == sql.ErrNoRows {
+		// Answer like for an account, or anybody could find out who has one.
+		acc = ds.Account{Kdf: ds.KdfPBKDF2, KdfIterations: defaultKdfIterations}
+	} else if err != nil {
+		apiHandler.handleError(w, err)
 		return
 	}
 
-	data := struct {
-		// Must upper case so that can write into response.
-		Kdf           int
-		KdfIterations int
-	}{
-		Kdf:           acc.Kdf,
-		KdfIterations: acc.KdfIterations,
-	}
+	data := accountKdf(acc)
 
 	d, err := json.Marshal(&data)
 	if err != nil {
-		apiHandler.logger.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(http.StatusText(500)))
+		apiHandler.handleError(w, err)
 		return
 	}
 
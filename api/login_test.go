@@ -17,7 +17,7 @@ import (
 var logT, _ = logger.New(5)
 var muxForTest *http.ServeMux
 var writer *httptest.ResponseRecorder
-var testHandler = New(mock.New(), "", logT, "")
+var testHandler = New(mock.New(), "", logT)
 
 func TestMain(m *testing.M) {
 	setUp()
@@ -74,6 +74,25 @@ func TestHandlePrelogin(t *testing.T) {
 	//}
 }
 
+func TestHandlePreloginUnknownEmail(t *testing.T) {
+	_, h := newSqliteHandler(t)
+	register(t, h, "nobody@example.com", "b2xk")
+
+	for email, iterations := range map[string]int{"nobody@example.com": 100000, "somebody@example.com": defaultKdfIterations} {
+		w := httptest.NewRecorder()
+		h.HandlePrelogin(w, httptest.NewRequest(http.MethodPost, "/api/accounts/prelogin", strings.NewReader(`{"email": "`+email+`"}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: response code is %v", email, w.Code)
+		}
+
+		var got struct{ Kdf, KdfIterations int }
+		json.Unmarshal(w.Body.Bytes(), &got)
+		if got.Kdf != 0 || got.KdfIterations != iterations {
+			t.Errorf("%v: kdf %v with %v iterations, want 0 with %v", email, got.Kdf, got.KdfIterations, iterations)
+		}
+	}
+}
+
 func TestHandleRegister(t *testing.T) {
 	got := strings.NewReader(`{
 "name": "",
@@ -2,6 +2,8 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strings"
@@ -15,8 +17,7 @@ func (apiHandler *APIHandler) AuthMiddleware(h http.HandlerFunc) http.HandlerFun
 		auth, ok := r.Header["Authorization"]
 		if len(auth) < 1 && !ok {
 			apiHandler.logger.Error("No auth header.")
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			writeError(w, http.StatusUnauthorized, "Unauthorized.")
 			return
 		}
 
@@ -32,15 +33,32 @@ func (apiHandler *APIHandler) AuthMiddleware(h http.HandlerFunc) http.HandlerFun
 		})
 
 		if nil != err {
-			apiHandler.logger.Error(err)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			apiHandler.handleError(w, &Error{Status: http.StatusUnauthorized, Message: "Unauthorized.", Err: err})
 			return
 		}
 
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 			email, ok := claims["email"].(string)
 			if ok {
+				// Tokens from before the account's security stamp changed
+				// don't count anymore, nor do those of deleted accounts.
+				acc, err := apiHandler.db.GetAccount(email)
+				if err == sql.ErrNoRows {
+					writeError(w, http.StatusUnauthorized, "Unauthorized.")
+					return
+				}
+				if err != nil {
+					apiHandler.handleError(w, err)
+					return
+				}
+
+				stamp, _ := claims["sstamp"].(string)
+				if subtle.ConstantTimeCompare([]byte(stamp), []byte(acc.SecurityStamp)) != 1 {
+					apiHandler.logger.Infof("Outdated security stamp of %v.", email)
+					writeError(w, http.StatusUnauthorized, "Unauthorized.")
+					return
+				}
+
 				// Add email to request's context so that can get account by email.
 				ctx := context.WithValue(r.Context(), "email", email)
 				h(w, r.WithContext(ctx))
@@ -48,7 +66,21 @@ func (apiHandler *APIHandler) AuthMiddleware(h http.HandlerFunc) http.HandlerFun
 			}
 		}
 
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+		writeError(w, http.StatusUnauthorized, "Unauthorized.")
+	}
+}
+
+// Middleware to protect the admin api with the admin token.
+func (apiHandler *APIHandler) AdminMiddleware(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if apiHandler.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiHandler.adminToken)) != 1 {
+			apiHandler.logger.Error("Wrong admin token.")
+			writeError(w, http.StatusUnauthorized, "Unauthorized.")
+			return
+		}
+
+		h(w, r)
 	}
 }
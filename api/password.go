@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/404cn/gowarden/ds"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PasswordHash is how the master password hash clients send is hashed again
+// before it's stored, so a leaked database can't be used to log in.
+type PasswordHash struct {
+	Algorithm string // argon2id or pbkdf2.
+	// Time cost of argon2id or iterations of pbkdf2.
+	Iterations  int
+	Memory      int // KiB, argon2id only.
+	Parallelism int // argon2id only.
+}
+
+const (
+	passwordSaltSize = 16
+	passwordKeySize  = 32
+)
+
+// NewPasswordHash checks the parameters of algorithm, 0 picks the default of a parameter.
+func NewPasswordHash(algorithm string, iterations, memory, parallelism int) (PasswordHash, error) {
+	p := PasswordHash{Algorithm: algorithm, Iterations: iterations, Memory: memory, Parallelism: parallelism}
+
+	switch algorithm {
+	case "argon2id":
+		if p.Iterations == 0 {
+			p.Iterations = 3
+		}
+		if p.Memory == 0 {
+			p.Memory = 64 << 10
+		}
+		if p.Parallelism == 0 {
+			p.Parallelism = 4
+		}
+		if p.Iterations < 1 || p.Memory < 8*p.Parallelism || p.Parallelism < 1 || p.Parallelism > 255 {
+			return p, fmt.Errorf("invalid argon2id parameters t=%d m=%d p=%d", p.Iterations, p.Memory, p.Parallelism)
+		}
+	case "pbkdf2":
+		if p.Iterations == 0 {
+			p.Iterations = 600000
+		}
+		if p.Iterations < 1 || p.Memory != 0 || p.Parallelism != 0 {
+			return p, fmt.Errorf("invalid pbkdf2 parameters i=%d, it takes no memory or parallelism", p.Iterations)
+		}
+	default:
+		return p, fmt.Errorf("unknown password hash %v, use argon2id or pbkdf2", algorithm)
+	}
+
+	return p, nil
+}
+
+// DefaultPasswordHash is used unless the handler is given another one.
+var DefaultPasswordHash, _ = NewPasswordHash("argon2id", 0, 0, 0)
+
+// params returns the part of a stored hash naming the algorithm and its
+// parameters, like "$argon2id$v=19$m=65536,t=3,p=4".
+func (p PasswordHash) params() string {
+	if p.Algorithm == "pbkdf2" {
+		return fmt.Sprintf("$pbkdf2-sha256$i=%d", p.Iterations)
+	}
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d", argon2.Version, p.Memory, p.Iterations, p.Parallelism)
+}
+
+func (p PasswordHash) key(password, salt []byte) []byte {
+	if p.Algorithm == "pbkdf2" {
+		return pbkdf2.Key(password, salt, p.Iterations, passwordKeySize, sha256.New)
+	}
+	return argon2.IDKey(password, salt, uint32(p.Iterations), uint32(p.Memory), uint8(p.Parallelism), passwordKeySize)
+}
+
+// hash hashes the base64 master password hash of a client with a new random
+// salt, the result names its parameters and salt as in "params$salt$key".
+func (p PasswordHash) hash(password string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, passwordSaltSize)
+	if _, err = rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	enc := base64.RawStdEncoding
+	return p.params() + "$" + enc.EncodeToString(salt) + "$" + enc.EncodeToString(p.key(b, salt)), nil
+}
+
+// outdated reports whether stored was made by other parameters than p.
+func (p PasswordHash) outdated(stored string) bool {
+	return !strings.HasPrefix(stored, p.params()+"$")
+}
+
+// parsePasswordHash returns the parameters, salt and key of a stored hash.
+func parsePasswordHash(stored string) (PasswordHash, []byte, []byte, error) {
+	var p PasswordHash
+
+	fields := strings.Split(stored, "$")
+	switch {
+	case len(fields) == 6 && fields[1] == "argon2id":
+		var version int
+		if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return p, nil, nil, errors.New("unsupported argon2 version " + fields[2])
+		}
+		p.Algorithm = "argon2id"
+		if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+			return p, nil, nil, err
+		}
+	case len(fields) == 5 && fields[1] == "pbkdf2-sha256":
+		p.Algorithm = "pbkdf2"
+		if _, err := fmt.Sscanf(fields[2], "i=%d", &p.Iterations); err != nil {
+			return p, nil, nil, err
+		}
+	default:
+		return p, nil, nil, errors.New("unknown password hash format")
+	}
+
+	// Salt and key are always the last two.
+	salt, err := base64.RawStdEncoding.DecodeString(fields[len(fields)-2])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[len(fields)-1])
+	return p, salt, key, err
+}
+
+// verifyPassword checks the master password hash a client sent against the
+// one stored for acc. Accounts from before per account salts store a PBKDF2
+// hash salted with their email.
+func verifyPassword(acc ds.Account, password string) (bool, error) {
+	stored := acc.MasterPasswordHash
+
+	if !strings.HasPrefix(stored, "$") {
+		legacy, err := makeKey(password, acc.Email, serverHashIterations(acc))
+		if err != nil {
+			return false, nil
+		}
+		return subtle.ConstantTimeCompare([]byte(legacy), []byte(stored)) == 1, nil
+	}
+
+	p, salt, key, err := parsePasswordHash(stored)
+	if err != nil {
+		return false, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return false, nil
+	}
+
+	return subtle.ConstantTimeCompare(p.key(b, salt), key) == 1, nil
+}
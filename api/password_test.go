@@ -0,0 +1,111 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/404cn/gowarden/ds"
+)
+
+// testPasswordHash is cheap enough for tests.
+var testPasswordHash, _ = NewPasswordHash("argon2id", 1, 64, 1)
+
+func TestPasswordHash(t *testing.T) {
+	pbkdf2Hash, err := NewPasswordHash("pbkdf2", 1000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []PasswordHash{testPasswordHash, pbkdf2Hash} {
+		first, err := p.hash("b2xk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := p.hash("b2xk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == second {
+			t.Errorf("%v: same hash twice, salts aren't random", p.Algorithm)
+		}
+		if p.outdated(first) {
+			t.Errorf("%v: fresh hash %v is outdated", p.Algorithm, first)
+		}
+
+		acc := ds.Account{Email: "nobody@example.com", MasterPasswordHash: first}
+		for password, want := range map[string]bool{"b2xk": true, "bmV3": false, "not base64!": false} {
+			if ok, err := verifyPassword(acc, password); err != nil || ok != want {
+				t.Errorf("%v: verifying %q returned %v, %v, want %v", p.Algorithm, password, ok, err, want)
+			}
+		}
+	}
+
+	stronger := testPasswordHash
+	stronger.Iterations++
+	if h, _ := testPasswordHash.hash("b2xk"); !stronger.outdated(h) {
+		t.Error("Hash with fewer iterations isn't outdated")
+	}
+}
+
+func TestNewPasswordHash(t *testing.T) {
+	if p, err := NewPasswordHash("argon2id", 0, 0, 0); err != nil || p.Iterations != 3 || p.Memory != 64<<10 || p.Parallelism != 4 {
+		t.Errorf("Default argon2id is %+v, %v", p, err)
+	}
+
+	for _, c := range []struct {
+		algorithm                       string
+		iterations, memory, parallelism int
+	}{
+		{"bcrypt", 0, 0, 0},
+		{"argon2id", -1, 0, 0},
+		{"argon2id", 1, 8, 4},
+		{"pbkdf2", 1000, 64, 0},
+	} {
+		if _, err := NewPasswordHash(c.algorithm, c.iterations, c.memory, c.parallelism); err == nil {
+			t.Errorf("%+v: no error", c)
+		}
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	db, h := newSqliteHandler(t)
+	const email = "nobody@example.com"
+
+	// A hash from before per account salts.
+	legacy, err := makeKey("b2xk", email, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddAccount(ds.Account{Email: email, MasterPasswordHash: legacy, KdfIterations: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.checkPassword(email, "bmV3"); err != errWrongPassword {
+		t.Errorf("Wrong password returned %v", err)
+	}
+	if acc, _ := db.GetAccount(email); acc.MasterPasswordHash != legacy {
+		t.Error("Hash changed by a wrong password")
+	}
+
+	for _, p := range []PasswordHash{testPasswordHash, {Algorithm: "pbkdf2", Iterations: 1000}} {
+		h.SetPasswordHash(p)
+
+		if _, err = h.checkPassword(email, "b2xk"); err != nil {
+			t.Fatalf("%v: %v", p.Algorithm, err)
+		}
+
+		acc, err := db.GetAccount(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(acc.MasterPasswordHash, p.params()+"$") {
+			t.Errorf("%v: stored hash %v wasn't upgraded", p.Algorithm, acc.MasterPasswordHash)
+		}
+
+		// And it still works.
+		if _, err = h.checkPassword(email, "b2xk"); err != nil {
+			t.Errorf("%v: %v", p.Algorithm, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+func (apiHandler *APIHandler) HandleGetDomains(w http.ResponseWriter, r *http.Request) {
+	email := getEmailRctx(r)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	d, err := json.Marshal(acc.Domains())
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
+
+// Update the custom equivalent domains and excluded global groups of an account.
+func (apiHandler *APIHandler) HandleUpdateDomains(w http.ResponseWriter, r *http.Request) {
+	var rdomains struct {
+		EquivalentDomains               [][]string `json:"equivalentDomains"`
+		ExcludedGlobalEquivalentDomains []int      `json:"excludedGlobalEquivalentDomains"`
+	}
+
+	err := decodeJSON(r, &rdomains)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	var v validator
+	validateDomains(&v, rdomains.EquivalentDomains, rdomains.ExcludedGlobalEquivalentDomains)
+	if err = v.error(); err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	email := getEmailRctx(r)
+	apiHandler.logger.Infof("%v is trying to update equivalent domains.", email)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	acc.EquivalentDomains = cleanDomainGroups(rdomains.EquivalentDomains)
+	acc.ExcludedGlobalEquivalentDomains = rdomains.ExcludedGlobalEquivalentDomains
+
+	err = apiHandler.db.UpdateDomains(acc.Id, acc.EquivalentDomains, acc.ExcludedGlobalEquivalentDomains)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	d, err := json.Marshal(acc.Domains())
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d)
+}
+
+// cleanDomainGroups lower cases domains and drops empty entries and groups.
+func cleanDomainGroups(groups [][]string) [][]string {
+	cleaned := make([][]string, 0, len(groups))
+
+	for _, group := range groups {
+		var domains []string
+		for _, domain := range group {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+
+		if len(domains) > 0 {
+			cleaned = append(cleaned, domains)
+		}
+	}
+
+	return cleaned
+}
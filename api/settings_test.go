@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/404cn/gowarden/ds"
+)
+
+func TestHandleDomains(t *testing.T) {
+	_, h := newSqliteHandler(t)
+	register(t, h, "nobody@example.com", "b2xk")
+
+	domains := func(w *httptest.ResponseRecorder) ds.Domains {
+		if w.Code != http.StatusOK {
+			t.Fatalf("Response code is %v: %v", w.Code, w.Body)
+		}
+		var domains ds.Domains
+		if err := json.Unmarshal(w.Body.Bytes(), &domains); err != nil {
+			t.Fatal(err)
+		}
+		return domains
+	}
+	get := func() ds.Domains {
+		w := httptest.NewRecorder()
+		h.HandleGetDomains(w, withEmail(httptest.NewRequest(http.MethodGet, "/api/settings/domains", nil)))
+		return domains(w)
+	}
+	put := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.HandleUpdateDomains(w, withEmail(httptest.NewRequest(http.MethodPut, "/api/settings/domains", strings.NewReader(body))))
+		return w
+	}
+
+	got := get()
+	if len(got.EquivalentDomains) != 0 || len(got.GlobalEquivalentDomains) != len(ds.GlobalDomains) {
+		t.Fatalf("New account has domains %+v", got)
+	}
+	if g := got.GlobalEquivalentDomains[0]; g.Type != 0 || g.Domains[0] != "youtube.com" || g.Excluded {
+		t.Errorf("First global group is %+v, want Google", g)
+	}
+
+	domains(put(`{"equivalentDomains": [[" Example.com", "example.net", ""], []], "excludedGlobalEquivalentDomains": [0, 1]}`))
+	got = get()
+	if len(got.EquivalentDomains) != 1 || strings.Join(got.EquivalentDomains[0], ",") != "example.com,example.net" {
+		t.Errorf("Equivalent domains are %v", got.EquivalentDomains)
+	}
+	for _, g := range got.GlobalEquivalentDomains {
+		if g.Excluded != (g.Type == 0 || g.Type == 1) {
+			t.Errorf("Group %v excluded: %v", g.Type, g.Excluded)
+		}
+	}
+
+	tooMany := "[" + strings.Repeat(`["a.com"],`, maxDomainGroups) + `["a.com"]]`
+	for _, body := range []string{
+		`{"equivalentDomains": ` + tooMany + `}`,
+		`{"equivalentDomains": [["` + strings.Repeat("a", maxPlainDomainLength+1) + `"]]}`,
+		`{"equivalentDomains": [[` + strings.Repeat(`"a.com",`, maxDomainsPerGroup) + `"a.com"]]}`,
+		`{"excludedGlobalEquivalentDomains": [67]}`,
+	} {
+		if w := put(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Got %v for %.60v", w.Code, body)
+		}
+	}
+	if got = get(); len(got.EquivalentDomains) != 1 {
+		t.Errorf("Rejected update changed the domains to %v", got.EquivalentDomains)
+	}
+}
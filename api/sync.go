@@ -1,8 +1,13 @@
 package api
 
 import (
+	"bufio"
 	"encoding/json"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/404cn/gowarden/ds"
 )
@@ -14,40 +19,157 @@ func (apiHandler APIHandler) HandleSync(w http.ResponseWriter, r *http.Request)
 
 	acc, err := apiHandler.db.GetAccount(email)
 	if err != nil {
-		apiHandler.logger.Error(err)
+		apiHandler.handleError(w, err)
+		return
+	}
+
+	excludeDomains, _ := strconv.ParseBool(r.URL.Query().Get("excludeDomains"))
+
+	// Every change to the vault bumps the account's revision date, so clients
+	// whose copy is at that revision already have nothing to download.
+	// Attachment urls in the response expire, but clients ask for fresh ones
+	// before downloading anyway.
+	etag := syncETag(acc, excludeDomains)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	profile := acc.Profile()
 
 	ciphers, err := apiHandler.db.GetCiphers(acc.Id)
 	if err != nil {
-		apiHandler.logger.Error(err)
+		apiHandler.handleError(w, err)
+		return
 	}
 
-	folders, err := apiHandler.db.GetFolders(acc.Id)
+	err = apiHandler.signAttachments(r, acc.Id, ciphers)
 	if err != nil {
-		apiHandler.logger.Error(err)
+		apiHandler.handleError(w, err)
+		return
 	}
 
-	domains := ds.Domains{
-		EquivalentDomains:       nil,
-		GlobalEquivalentDomains: nil,
-		Object:                  "domains",
+	folders, err := apiHandler.db.GetFolders(acc.Id)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
 	}
 
 	data := ds.SyncData{
 		Profile: profile,
 		Folders: folders,
 		Ciphers: ciphers,
-		Domains: domains,
 		Object:  "sync",
 	}
 
-	jsonData, err := json.Marshal(&data)
+	if !excludeDomains {
+		domains := acc.Domains()
+		data.Domains = &domains
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	bw := bufio.NewWriter(w)
+	err = writeSync(bw, &data)
+	if err == nil {
+		err = bw.Flush()
+	}
 	if err != nil {
+		// Too late to change the status, the client sees a truncated body.
 		apiHandler.logger.Error(err)
 	}
+}
+
+// writeSync writes data as json like json.Marshal would, but encodes ciphers
+// one by one so large vaults are never held in memory as a whole document.
+func writeSync(w io.Writer, data *ds.SyncData) error {
+	enc := json.NewEncoder(w)
+	write := func(s string) error {
+		_, err := io.WriteString(w, s)
+		return err
+	}
+
+	if err := write(`{"Profile":`); err != nil {
+		return err
+	}
+	if err := enc.Encode(&data.Profile); err != nil {
+		return err
+	}
+
+	if err := write(`,"Folders":`); err != nil {
+		return err
+	}
+	if err := enc.Encode(data.Folders); err != nil {
+		return err
+	}
+
+	if err := write(`,"Ciphers":[`); err != nil {
+		return err
+	}
+	for i := range data.Ciphers {
+		if i > 0 {
+			if err := write(","); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(&data.Ciphers[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := write(`],"Domains":`); err != nil {
+		return err
+	}
+	if err := enc.Encode(data.Domains); err != nil {
+		return err
+	}
+
+	if err := write(`,"Object":`); err != nil {
+		return err
+	}
+	if err := enc.Encode(data.Object); err != nil {
+		return err
+	}
+
+	return write("}")
+}
+
+// HandleRevisionDate returns when the vault last changed, in milliseconds
+// since the epoch. Clients poll it to decide whether to sync.
+func (apiHandler *APIHandler) HandleRevisionDate(w http.ResponseWriter, r *http.Request) {
+	email := getEmailRctx(r)
+
+	acc, err := apiHandler.db.GetAccount(email)
+	if err != nil {
+		apiHandler.handleError(w, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonData)
+	w.Write([]byte(strconv.FormatInt(unixMilli(acc.RevisionDate), 10)))
+}
+
+func syncETag(acc ds.Account, excludeDomains bool) string {
+	tag := acc.Id + "-" + strconv.FormatInt(unixMilli(acc.RevisionDate), 36)
+	if excludeDomains {
+		tag += "-nodomains"
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatch reports whether an If-None-Match header matches etag.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
 }
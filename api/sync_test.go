@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/404cn/gowarden/ds"
+	"github.com/404cn/gowarden/sqlite/mock"
+)
+
+func syncRequest(target, ifNoneMatch string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	return withEmail(req)
+}
+
+// withEmail authenticates req like AuthMiddleware does.
+func withEmail(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), "email", "nobody@example.com"))
+}
+
+func TestHandleSyncNotModified(t *testing.T) {
+	w := httptest.NewRecorder()
+	testHandler.HandleSync(w, syncRequest("/api/sync", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Response code is %v", w.Code)
+	}
+
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("No ETag in sync response")
+	}
+
+	w = httptest.NewRecorder()
+	testHandler.HandleSync(w, syncRequest("/api/sync", etag))
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Response code with matching ETag is %v", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Not modified response has a body: %q", w.Body.String())
+	}
+
+	// The same revision without domains is a different response.
+	w = httptest.NewRecorder()
+	testHandler.HandleSync(w, syncRequest("/api/sync?excludeDomains=true", etag))
+	if w.Code != http.StatusOK {
+		t.Errorf("Response code without domains is %v", w.Code)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["Domains"] != nil {
+		t.Errorf("Domains not excluded: %v", data["Domains"])
+	}
+}
+
+func TestEtagMatch(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		match  bool
+	}{
+		{"", false},
+		{`"a"`, true},
+		{`W/"a"`, true},
+		{`"b", "a"`, true},
+		{`*`, true},
+		{`"b"`, false},
+	} {
+		if got := etagMatch(c.header, `"a"`); got != c.match {
+			t.Errorf("etagMatch(%q) = %v, want %v", c.header, got, c.match)
+		}
+	}
+}
+
+func testVault(n int) []ds.Cipher {
+	ciphers := make([]ds.Cipher, n)
+	for i := range ciphers {
+		ciphers[i] = ds.Cipher{
+			Type:         1,
+			Id:           fmt.Sprint("cipher", i),
+			Name:         "2.name",
+			RevisionDate: time.Unix(1590000000, 0),
+			Login: ds.Login{
+				Username: "2.username",
+				Password: "2.password",
+				Uris:     []ds.Uri{{Uri: "2.uri"}},
+			},
+			Attachments: []ds.Attachment{{Id: fmt.Sprint("attachment", i)}},
+			Object:      "cipher",
+		}
+	}
+	return ciphers
+}
+
+func TestWriteSync(t *testing.T) {
+	domains := ds.Account{}.Domains()
+	data := ds.SyncData{
+		Profile: ds.Account{Email: "nobody@example.com"}.Profile(),
+		Folders: []ds.Folder{{Id: "folder", Object: "folder"}},
+		Ciphers: testVault(3),
+		Domains: &domains,
+		Object:  "sync",
+	}
+
+	want, err := json.Marshal(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf, got bytes.Buffer
+	if err = writeSync(&buf, &data); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Compact(&got, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.String() != string(want) {
+		t.Errorf("writeSync wrote\n%s\nwant\n%s", got.String(), want)
+	}
+}
+
+// vaultMock serves a fixed vault.
+type vaultMock struct {
+	*mock.Mock
+	ciphers []ds.Cipher
+}
+
+func (v vaultMock) GetCiphers(s string) ([]ds.Cipher, error) {
+	return v.ciphers, nil
+}
+
+func BenchmarkHandleSync10k(b *testing.B) {
+	h := New(vaultMock{mock.New(), testVault(10000)}, "key", logT)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.HandleSync(w, syncRequest("/api/sync", ""))
+		if w.Code != http.StatusOK {
+			b.Fatalf("Response code is %v", w.Code)
+		}
+	}
+}
@@ -1,47 +1,139 @@
 package api
 
 import (
+	"strings"
+	"time"
+
 	"github.com/404cn/gowarden/ds"
+	"github.com/404cn/gowarden/favicon"
+	"github.com/404cn/gowarden/storage"
 	"go.uber.org/zap"
 )
 
 const (
 	jwtExpiresin = 3600
+	// How long a presigned attachment download link stays valid.
+	attachmentUrlExpiresin = 300
+	// How long the token verifying a new email address stays valid.
+	emailTokenExpiresin = 3600
+	// Tries to enter the token before a new one has to be requested.
+	maxEmailTokenAttempts = 3
+	// Attachment parts bigger than this are buffered on disk while parsing.
+	multipartMemory = 32 << 20
+	// Room for the multipart envelope around an attachment of max size.
+	multipartOverhead = 1 << 20
 )
 
 type handler interface {
 	AddAccount(ds.Account) error
 	GetAccount(string) (ds.Account, error)
-	UpdateAccount(ds.Account) error
+	UpdateRefreshToken(string, string) error
+	UpdateKeys(string, ds.Keys) error
+	UpdateKdf(ds.Account) error
+	UpdateMasterPasswordHash(string, string) error
+	UpdateMasterPassword(string, string, string, string) error
+	RotateSecurityStamp(string) error
+	UpdateProfile(ds.Account) error
+	SetEmailToken(string, string, string, time.Time) error
+	CountEmailTokenAttempt(string) (int, error)
+	UpdateEmail(string, string, string, string) error
+	UpdateDomains(string, [][]string, []int) error
+	DeleteAccount(string) ([]string, error)
+	PurgeVault(string) ([]string, error)
 
 	AddFolder(string, string) (ds.Folder, error)
-	DeleteFolder(string) error
-	RenameFolder(string, string) (ds.Folder, error)
+	DeleteFolder(string, string) error
+	RenameFolder(string, string, string) (ds.Folder, error)
 
 	AddCipher(ds.Cipher, string) (ds.Cipher, error)
-	UpdateCipher(ds.Cipher, string) (ds.Cipher, error)
+	GetCipher(string, string) (ds.Cipher, error)
+	UpdateCipher(ds.Cipher, string, *time.Time) (ds.Cipher, error)
+	UpdateCipherPartial(string, string, string, bool) (ds.Cipher, error)
+	MoveCiphers(string, string, []string) error
+	ImportCiphers(string, []ds.Folder, []ds.Cipher) error
 	DeleteCipher(string, string) error
 
 	GetCiphers(string) ([]ds.Cipher, error)
 	GetFolders(string) ([]ds.Folder, error)
+	GetFolder(string, string) (ds.Folder, error)
+
+	AddAttachment(string, string, ds.Attachment) (ds.Cipher, error)
+	DeleteAttachment(string, string, string) (string, error)
+	GetAttachment(string, string, string) (ds.Attachment, error)
 
-	AddAttachment(string, ds.Attachment) (ds.Cipher, error)
-	DeleteAttachment(string, string) (string, error)
-	GetAttachment(string, string) (ds.Attachment, error)
+	GetStorageUsage(string) (int64, error)
+	GetStorageUsages() ([]ds.StorageUsage, error)
 }
 
 type APIHandler struct {
-	db          handler
-	signingKey  string
-	logger      *zap.SugaredLogger
-	proxyServer string
+	db         handler
+	signingKey string
+	logger     *zap.SugaredLogger
+	icons      *favicon.Service
+	blobs      storage.Store
+	adminToken string
+	// Public url of gowarden like https://example.com/vault, "" to take it
+	// from requests.
+	domain string
+	// How master password hashes are stored.
+	passwordHash PasswordHash
+	// gowarden can't send emails, tokens verifying new email addresses are
+	// only written to the log and only if this is set.
+	logEmailTokens bool
+
+	maxAttachmentSize int64
+	storageQuota      int64
+	// Serializes the attachment uploads of each account.
+	uploadLocks *accountLocks
 }
 
-func New(db handler, key string, sugar *zap.SugaredLogger, proxy string) *APIHandler {
+func New(db handler, key string, sugar *zap.SugaredLogger) *APIHandler {
 	return &APIHandler{
-		db:          db,
-		signingKey:  key,
-		logger:      sugar,
-		proxyServer: proxy,
+		db:           db,
+		signingKey:   key,
+		logger:       sugar,
+		blobs:        storage.NewFS("attachments"),
+		passwordHash: DefaultPasswordHash,
+		uploadLocks:  newAccountLocks(),
 	}
 }
+
+// SetIconService sets the service used to answer icon requests.
+func (apiHandler *APIHandler) SetIconService(icons *favicon.Service) {
+	apiHandler.icons = icons
+}
+
+// SetBlobStore changes where attachments are stored, default is the local attachments folder.
+func (apiHandler *APIHandler) SetBlobStore(store storage.Store) {
+	apiHandler.blobs = store
+}
+
+// SetStorageLimits sets the max size of one attachment and the total
+// attachment storage of an account in bytes, 0 means unlimited.
+func (apiHandler *APIHandler) SetStorageLimits(maxAttachmentSize, quota int64) {
+	apiHandler.maxAttachmentSize = maxAttachmentSize
+	apiHandler.storageQuota = quota
+}
+
+// SetPasswordHash changes how master password hashes are stored, accounts
+// stored with other parameters are upgraded when they log in.
+func (apiHandler *APIHandler) SetPasswordHash(p PasswordHash) {
+	apiHandler.passwordHash = p
+}
+
+// SetDomain sets the public url clients reach gowarden at, links handed to
+// clients start with it.
+func (apiHandler *APIHandler) SetDomain(domain string) {
+	apiHandler.domain = strings.TrimSuffix(domain, "/")
+}
+
+// SetLogEmailTokens enables email changes by writing the tokens verifying
+// the new addresses to the log, where the admin has to pass them on.
+func (apiHandler *APIHandler) SetLogEmailTokens(enabled bool) {
+	apiHandler.logEmailTokens = enabled
+}
+
+// SetAdminToken sets the bearer token used to access the admin api.
+func (apiHandler *APIHandler) SetAdminToken(token string) {
+	apiHandler.adminToken = token
+}
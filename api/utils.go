@@ -5,8 +5,10 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"io"
 	"log"
 	"strings"
+	"sync"
 
 	"net/http"
 
@@ -31,15 +33,70 @@ func makeKey(password, salt string, iterations int) (string, error) {
 	return base64.StdEncoding.EncodeToString(masterKey), nil
 }
 
-func checkPassword(email, password string, db handler) (ds.Account, error) {
-	acc, err := db.GetAccount(email)
+// Iterations of the server side hash of Argon2id accounts.
+const argon2idServerIterations = 100000
+
+// serverHashIterations returns the PBKDF2 iterations of the email salted
+// server side hash accounts had before PasswordHash. PBKDF2 accounts used
+// their own KDF iterations, Argon2id iterations are far too few.
+func serverHashIterations(acc ds.Account) int {
+	if acc.Kdf == ds.KdfArgon2id {
+		return argon2idServerIterations
+	}
+	return acc.KdfIterations
+}
+
+// kdfParams are the KDF settings of an account the way prelogin and token
+// responses tell clients, memory and parallelism are null for PBKDF2.
+type kdfParams struct {
+	Kdf            int
+	KdfIterations  int
+	KdfMemory      *int
+	KdfParallelism *int
+}
+
+// PBKDF2 iterations bitwarden clients register with, told to anybody asking
+// for the KDF of an email without an account.
+const defaultKdfIterations = 600000
+
+func accountKdf(acc ds.Account) kdfParams {
+	params := kdfParams{Kdf: acc.Kdf, KdfIterations: acc.KdfIterations}
+	if acc.Kdf == ds.KdfArgon2id {
+		params.KdfMemory, params.KdfParallelism = &acc.KdfMemory, &acc.KdfParallelism
+	}
+	return params
+}
+
+var errWrongPassword = errors.New("Password wrong.")
+
+// checkPassword returns the account of email if password is its master
+// password hash. Hashes stored with older parameters are upgraded on the way.
+func (apiHandler *APIHandler) checkPassword(email, password string) (ds.Account, error) {
+	acc, err := apiHandler.db.GetAccount(email)
 	if nil != err {
 		return ds.Account{}, err
 	}
 
-	passwordHash, _ := makeKey(password, acc.Email, acc.KdfIterations)
-	if passwordHash != acc.MasterPasswordHash {
-		return ds.Account{}, errors.New("Password wrong.")
+	ok, err := verifyPassword(acc, password)
+	if err != nil {
+		return ds.Account{}, err
+	}
+	if !ok {
+		return ds.Account{}, errWrongPassword
+	}
+
+	if apiHandler.passwordHash.outdated(acc.MasterPasswordHash) {
+		hash, err := apiHandler.passwordHash.hash(password)
+		if err == nil {
+			err = apiHandler.db.UpdateMasterPasswordHash(acc.Id, hash)
+		}
+		// The password was right, logging in doesn't depend on the upgrade.
+		if err != nil {
+			apiHandler.logger.Error(err)
+		} else {
+			acc.MasterPasswordHash = hash
+			apiHandler.logger.Infof("Upgraded the password hash of %v.", acc.Email)
+		}
 	}
 
 	return acc, nil
@@ -54,3 +111,64 @@ func createRefreshToken() string {
 	}
 	return base64.StdEncoding.EncodeToString(b)
 }
+
+// accountLocks hands out a mutex per account, kept only while it's in use.
+type accountLocks struct {
+	mu    sync.Mutex
+	locks map[string]*accountLock
+}
+
+type accountLock struct {
+	sync.Mutex
+	users int
+}
+
+func newAccountLocks() *accountLocks {
+	return &accountLocks{locks: make(map[string]*accountLock)}
+}
+
+// lock locks the mutex of accId and returns the function unlocking it.
+func (l *accountLocks) lock(accId string) func() {
+	l.mu.Lock()
+	lock, ok := l.locks[accId]
+	if !ok {
+		lock = &accountLock{}
+		l.locks[accId] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, accId)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// limitedBody counts what is read from a body limited by http.MaxBytesReader
+// to tell its error apart from others.
+type limitedBody struct {
+	io.ReadCloser
+	limit, read int64
+	err         error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// exceeded reports whether reading stopped at the limit.
+func (b *limitedBody) exceeded() bool {
+	return b.err != nil && b.read >= b.limit
+}
@@ -0,0 +1,320 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/404cn/gowarden/ds"
+)
+
+// Longest encrypted values gowarden stores, the lengths of the encoded strings.
+const (
+	maxEncStringLength      = 1000
+	maxEncPasswordLength    = 5000
+	maxEncFieldValueLength  = 5000
+	maxEncNotesLength       = 10000
+	maxEncUriLength         = 10000
+	maxPlainNameLength      = 50
+	maxPlainEmailLength     = 256
+	maxPlainPasswordHint    = 50
+	maxPlainCultureLength   = 10
+	maxMasterPasswordLength = 300
+	// Custom equivalent domains of an account.
+	maxDomainGroups      = 100
+	maxDomainsPerGroup   = 100
+	maxPlainDomainLength = 253
+	// Members of a cipher gowarden doesn't know, all of its objects added up.
+	maxExtraMembers = 50
+	maxExtraSize    = 50000
+)
+
+// Parts of an EncString of each encryption type, in the order they are
+// joined with "|". AES types are type 0 to 2, RSA types 3 to 6.
+var encStringParts = map[int][]string{
+	0: {"iv", "data"},
+	1: {"iv", "data", "mac"},
+	2: {"iv", "data", "mac"},
+	3: {"data"},
+	4: {"data"},
+	5: {"data", "mac"},
+	6: {"data", "mac"},
+}
+
+// checkEncString returns what is wrong with s as an EncString, the
+// "type.iv|data|mac" format clients encrypt every vault value to, or "".
+func checkEncString(s string) string {
+	encType := -1
+	body := s
+
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		t, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return "is not an encrypted string."
+		}
+		encType, body = t, s[i+1:]
+	}
+
+	pieces := strings.Split(body, "|")
+	if encType == -1 {
+		// Old clients leave the type out.
+		encType = 0
+		if len(pieces) == 3 {
+			encType = 1
+		}
+	}
+
+	parts, ok := encStringParts[encType]
+	if !ok {
+		return "has an unknown encryption type " + strconv.Itoa(encType) + "."
+	}
+	if len(pieces) != len(parts) {
+		return "is not an encrypted string of type " + strconv.Itoa(encType) + "."
+	}
+
+	for i, part := range parts {
+		b, err := base64.StdEncoding.DecodeString(pieces[i])
+		if err != nil || len(b) == 0 {
+			return "has an invalid " + part + " part."
+		}
+
+		switch {
+		case part == "iv" && len(b) != 16,
+			part == "mac" && len(b) != 32,
+			part == "data" && encType <= 2 && len(b)%16 != 0:
+			return "has an invalid " + part + " part."
+		}
+	}
+
+	return ""
+}
+
+// validator collects the field errors of a request.
+type validator struct {
+	err *Error
+}
+
+func (v *validator) add(field, message string) {
+	if v.err == nil {
+		v.err = validationError(field, message)
+		return
+	}
+	v.err.Add(field, message)
+}
+
+// encString checks an encrypted value, an empty one only if it's required.
+func (v *validator) encString(field, s string, maxLength int, required bool) {
+	if s == "" {
+		if required {
+			v.add(field, "The "+field+" field is required.")
+		}
+		return
+	}
+
+	if len(s) > maxLength {
+		v.add(field, "The "+field+" field must be at most "+strconv.Itoa(maxLength)+" characters long.")
+		return
+	}
+
+	if problem := checkEncString(s); problem != "" {
+		v.add(field, "The "+field+" field "+problem)
+	}
+}
+
+func (v *validator) plain(field, s string, maxLength int, required bool) {
+	if s == "" && required {
+		v.add(field, "The "+field+" field is required.")
+	}
+	if len(s) > maxLength {
+		v.add(field, "The "+field+" field must be at most "+strconv.Itoa(maxLength)+" characters long.")
+	}
+}
+
+// email checks a required plain e-mail address.
+func (v *validator) email(field, s string) {
+	v.plain(field, s, maxPlainEmailLength, true)
+	if s != "" {
+		if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+			v.add(field, "The "+field+" field is not a valid e-mail address.")
+		}
+	}
+}
+
+// error returns the collected errors, nil if there are none.
+func (v *validator) error() error {
+	if v.err == nil {
+		return nil
+	}
+	return v.err
+}
+
+// validateCipher checks that every encrypted value of a cipher is an
+// EncString and that only the part of its type is set. Types gowarden
+// doesn't know, like SSH keys, keep their part in Extra and only get their
+// common values checked. Field names are prefixed with prefix, for ciphers
+// inside of other requests.
+func validateCipher(v *validator, prefix string, cipher ds.Cipher) {
+	v.encString(prefix+"Name", cipher.Name, maxEncStringLength, true)
+	v.encString(prefix+"Notes", cipher.Notes, maxEncNotesLength, false)
+
+	for i, field := range cipher.Fields {
+		name := prefix + "Fields[" + strconv.Itoa(i) + "]."
+		v.encString(name+"Name", field.Name, maxEncStringLength, false)
+		v.encString(name+"Value", field.Value, maxEncFieldValueLength, false)
+	}
+
+	for i, history := range cipher.PasswordHistory {
+		v.encString(prefix+"PasswordHistory["+strconv.Itoa(i)+"].Password", history.Password, maxEncPasswordLength, true)
+	}
+
+	parts := map[int]struct {
+		name  string
+		value interface{}
+	}{
+		1: {"Login", cipher.Login},
+		2: {"SecureNote", cipher.SecureNote},
+		3: {"Card", cipher.Card},
+		4: {"Identity", cipher.Identity},
+	}
+
+	if cipher.Type < 1 {
+		v.add(prefix+"Type", "The Type field has an invalid cipher type "+strconv.Itoa(cipher.Type)+".")
+	}
+	for t, part := range parts {
+		if t != cipher.Type && !reflect.ValueOf(part.value).IsZero() {
+			v.add(prefix+part.name, "The "+part.name+" field must be empty for a cipher of type "+strconv.Itoa(cipher.Type)+".")
+		}
+	}
+
+	switch cipher.Type {
+	case 1:
+		login := cipher.Login
+		v.encString(prefix+"Login.Username", login.Username, maxEncStringLength, false)
+		v.encString(prefix+"Login.Password", login.Password, maxEncPasswordLength, false)
+		v.encString(prefix+"Login.Totp", login.Totp, maxEncStringLength, false)
+		v.encString(prefix+"Login.Uri", login.Uri, maxEncUriLength, false)
+		for i, uri := range login.Uris {
+			v.encString(prefix+"Login.Uris["+strconv.Itoa(i)+"].Uri", uri.Uri, maxEncUriLength, false)
+		}
+	case 3:
+		encStrings(v, prefix+"Card.", cipher.Card)
+	case 4:
+		encStrings(v, prefix+"Identity.", cipher.Identity)
+	}
+
+	extras := []ds.Extra{cipher.Extra, cipher.Login.Extra, cipher.SecureNote.Extra, cipher.Card.Extra, cipher.Identity.Extra}
+	for _, uri := range cipher.Login.Uris {
+		extras = append(extras, uri.Extra)
+	}
+	for _, field := range cipher.Fields {
+		extras = append(extras, field.Extra)
+	}
+	for _, history := range cipher.PasswordHistory {
+		extras = append(extras, history.Extra)
+	}
+	validateExtra(v, prefix, extras)
+}
+
+// validateExtra limits the unknown members of a cipher, they are kept
+// without being checked.
+func validateExtra(v *validator, prefix string, extras []ds.Extra) {
+	members, size := 0, 0
+	for _, extra := range extras {
+		for name, value := range extra {
+			members++
+			size += len(name) + len(value)
+		}
+	}
+
+	if members > maxExtraMembers {
+		v.add(prefix+"Extra", "At most "+strconv.Itoa(maxExtraMembers)+" unknown members are allowed.")
+	}
+	if size > maxExtraSize {
+		v.add(prefix+"Extra", "The unknown members must not be longer than "+strconv.Itoa(maxExtraSize)+" bytes.")
+	}
+}
+
+// encStrings checks every string field of the struct s as an optional EncString.
+func encStrings(v *validator, prefix string, s interface{}) {
+	value := reflect.ValueOf(s)
+	for i := 0; i < value.NumField(); i++ {
+		if f := value.Field(i); f.Kind() == reflect.String {
+			v.encString(prefix+value.Type().Field(i).Name, f.String(), maxEncStringLength, false)
+		}
+	}
+}
+
+// validateAccount checks the fields of a registering account.
+func validateAccount(v *validator, acc ds.Account) {
+	v.plain("Name", acc.Name, maxPlainNameLength, false)
+	v.email("Email", acc.Email)
+
+	v.plain("MasterPasswordHash", acc.MasterPasswordHash, maxMasterPasswordLength, true)
+	v.plain("MasterPasswordHint", acc.MasterPasswordHint, maxPlainPasswordHint, false)
+	v.encString("Key", acc.Key, maxEncStringLength, true)
+	validateKeys(v, acc.Keys)
+
+	validateKdf(v, acc)
+}
+
+// validateKdf checks the KDF settings of an account are ones clients support
+// and not too weak.
+func validateKdf(v *validator, acc ds.Account) {
+	between := func(field string, value, min, max int) {
+		if value < min || value > max {
+			v.add(field, "The "+field+" field must be between "+strconv.Itoa(min)+" and "+strconv.Itoa(max)+".")
+		}
+	}
+
+	switch acc.Kdf {
+	case ds.KdfPBKDF2:
+		between("KdfIterations", acc.KdfIterations, 5000, 2000000)
+	case ds.KdfArgon2id:
+		between("KdfIterations", acc.KdfIterations, 2, 10)
+		between("KdfMemory", acc.KdfMemory, 15, 1024)
+		between("KdfParallelism", acc.KdfParallelism, 1, 16)
+	default:
+		v.add("Kdf", "The Kdf field has an unknown KDF "+strconv.Itoa(acc.Kdf)+".")
+	}
+}
+
+// validateKeys checks the key pair of an account, the private key is
+// encrypted with the account's key.
+func validateKeys(v *validator, keys ds.Keys) {
+	if keys.PublicKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(keys.PublicKey); err != nil {
+			v.add("Keys.PublicKey", "The Keys.PublicKey field is not base64.")
+		}
+	}
+	v.encString("Keys.EncryptedPrivateKey", keys.EncryptedPrivateKey, maxEncNotesLength, false)
+}
+
+// validateDomains checks the equivalent domains settings of an account,
+// excluded global groups must exist.
+func validateDomains(v *validator, groups [][]string, excluded []int) {
+	if len(groups) > maxDomainGroups {
+		v.add("EquivalentDomains", "At most "+strconv.Itoa(maxDomainGroups)+" equivalent domain groups are allowed.")
+	}
+	for i, group := range groups {
+		field := "EquivalentDomains[" + strconv.Itoa(i) + "]"
+		if len(group) > maxDomainsPerGroup {
+			v.add(field, "At most "+strconv.Itoa(maxDomainsPerGroup)+" domains are allowed in a group.")
+			continue
+		}
+		for j, domain := range group {
+			v.plain(field+"["+strconv.Itoa(j)+"]", domain, maxPlainDomainLength, false)
+		}
+	}
+
+	known := make(map[int]bool, len(ds.GlobalDomains))
+	for _, g := range ds.GlobalDomains {
+		known[g.Type] = true
+	}
+	for i, t := range excluded {
+		if !known[t] {
+			v.add("ExcludedGlobalEquivalentDomains["+strconv.Itoa(i)+"]", "Unknown global equivalent domains type "+strconv.Itoa(t)+".")
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/404cn/gowarden/ds"
+)
+
+// testEncString is a well formed EncString of type 2.
+const testEncString = "2.AAAAAAAAAAAAAAAAAAAAAA==|AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=|AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+func TestCheckEncString(t *testing.T) {
+	const (
+		iv   = "AAAAAAAAAAAAAAAAAAAAAA=="
+		data = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+		mac  = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	)
+
+	for _, c := range []struct {
+		s     string
+		valid bool
+	}{
+		{testEncString, true},
+		{"0." + iv + "|" + data, true},
+		{"1." + iv + "|" + data + "|" + mac, true},
+		{"4." + data, true},
+		{"6." + data + "|" + mac, true},
+		// Old clients leave the type out.
+		{iv + "|" + data + "|" + mac, true},
+		{iv + "|" + data, true},
+
+		{"plain text", false},
+		{"2.name", false},
+		{"7." + data, false},
+		{"x." + iv + "|" + data + "|" + mac, false},
+		{"2." + iv + "|" + data, false},
+		{"2." + data + "|" + data + "|" + mac, false},
+		{"2." + iv + "|AAAA|" + mac, false},
+		{"2." + iv + "|" + data + "|" + iv, false},
+		{"2." + iv + "|not base64!|" + mac, false},
+		{"2." + iv + "||" + mac, false},
+	} {
+		if problem := checkEncString(c.s); (problem == "") != c.valid {
+			t.Errorf("%q: got %q, want valid %v", c.s, problem, c.valid)
+		}
+	}
+}
+
+func TestValidateCipher(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		cipher ds.Cipher
+		fields []string
+	}{
+		{"login", ds.Cipher{Type: 1, Name: testEncString, Login: ds.Login{Username: testEncString, Uris: []ds.Uri{{Uri: testEncString}}}}, nil},
+		{"note", ds.Cipher{Type: 2, Name: testEncString, Notes: testEncString}, nil},
+		{"card", ds.Cipher{Type: 3, Name: testEncString, Card: ds.Card{Number: testEncString}}, nil},
+		{"missing name", ds.Cipher{Type: 2}, []string{"Name"}},
+		{"plain text", ds.Cipher{Type: 1, Name: "name", Login: ds.Login{Password: "hunter2", Uris: []ds.Uri{{Uri: "https://example.com"}}}},
+			[]string{"Name", "Login.Password", "Login.Uris[0].Uri"}},
+		{"plain identity", ds.Cipher{Type: 4, Name: testEncString, Identity: ds.Identity{SSN: "123-45-6789"}}, []string{"Identity.SSN"}},
+		{"fields", ds.Cipher{Type: 2, Name: testEncString, Fields: []ds.Field{{Name: testEncString, Value: "value"}}}, []string{"Fields[0].Value"}},
+		{"history", ds.Cipher{Type: 1, Name: testEncString, PasswordHistory: []ds.PasswordHistory{{Password: ""}}}, []string{"PasswordHistory[0].Password"}},
+		{"ssh key", ds.Cipher{Type: 5, Name: testEncString, Extra: ds.Extra{"SshKey": []byte(`{"PrivateKey": "` + testEncString + `"}`)}}, nil},
+		{"too many unknown members", ds.Cipher{Type: 1, Name: testEncString, Extra: manyMembers(maxExtraMembers / 2), Login: ds.Login{Extra: manyMembers(maxExtraMembers/2 + 1)}}, []string{"Extra"}},
+		{"too long unknown members", ds.Cipher{Type: 5, Name: testEncString, Extra: ds.Extra{"SshKey": []byte(`"` + strings.Repeat("A", maxExtraSize) + `"`)}}, []string{"Extra"}},
+		{"unknown type with a known part", ds.Cipher{Type: 5, Name: testEncString, Card: ds.Card{Number: testEncString}}, []string{"Card"}},
+		{"unknown type without name", ds.Cipher{Type: 5}, []string{"Name"}},
+		{"invalid type", ds.Cipher{Type: 0, Name: testEncString}, []string{"Type"}},
+		{"wrong part", ds.Cipher{Type: 2, Name: testEncString, Login: ds.Login{Username: testEncString}}, []string{"Login"}},
+		{"too long", ds.Cipher{Type: 2, Name: testEncString + strings.Repeat("A", maxEncStringLength)}, []string{"Name"}},
+	} {
+		var v validator
+		validateCipher(&v, "", c.cipher)
+
+		if c.fields == nil {
+			if err := v.error(); err != nil {
+				t.Errorf("%v: unexpected error %v", c.name, v.err.ValidationErrors)
+			}
+			continue
+		}
+
+		if v.err == nil || v.err.Status != http.StatusBadRequest {
+			t.Errorf("%v: got %v, want a validation error", c.name, v.err)
+			continue
+		}
+		if len(v.err.ValidationErrors) != len(c.fields) {
+			t.Errorf("%v: got errors %v, want errors for %v", c.name, v.err.ValidationErrors, c.fields)
+		}
+		for _, field := range c.fields {
+			if len(v.err.ValidationErrors[field]) == 0 {
+				t.Errorf("%v: no error for field %v, got %v", c.name, field, v.err.ValidationErrors)
+			}
+		}
+	}
+}
+
+// manyMembers returns an Extra with n members.
+func manyMembers(n int) ds.Extra {
+	extra := make(ds.Extra, n)
+	for i := 0; i < n; i++ {
+		extra["member"+strconv.Itoa(i)] = []byte("1")
+	}
+	return extra
+}
+
+func TestValidateAccount(t *testing.T) {
+	acc := ds.Account{
+		Email:              "nobody@example.com",
+		MasterPasswordHash: "hash",
+		Key:                testEncString,
+		KdfIterations:      100000,
+		Keys:               ds.Keys{PublicKey: "AAAA", EncryptedPrivateKey: testEncString},
+	}
+
+	var v validator
+	validateAccount(&v, acc)
+	if err := v.error(); err != nil {
+		t.Fatalf("Unexpected error %v", v.err.ValidationErrors)
+	}
+
+	acc.Email, acc.Key, acc.KdfIterations, acc.Keys.PublicKey = "nobody", "key", 1, "not base64!"
+	validateAccount(&v, acc)
+	for _, field := range []string{"Email", "Key", "KdfIterations", "Keys.PublicKey"} {
+		if v.err == nil || len(v.err.ValidationErrors[field]) == 0 {
+			t.Errorf("No error for field %v", field)
+		}
+	}
+}
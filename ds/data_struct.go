@@ -1,6 +1,7 @@
 package ds
 
 import (
+	"errors"
 	"fmt"
 	"time"
 )
@@ -24,16 +25,44 @@ type SyncData struct {
 	Profile Profile
 	Folders []Folder
 	Ciphers []Cipher
-	Domains Domains
+	Domains *Domains // Left out when syncing with excludeDomains.
 	Object  string
 }
 
 type Domains struct {
-	EquivalentDomains       []string
+	EquivalentDomains       [][]string
 	GlobalEquivalentDomains []GlobalEquivalentDomains
 	Object                  string
 }
 
+// domains used in autofill, excluded global groups are marked as Excluded
+func (acc Account) Domains() Domains {
+	excluded := make(map[int]bool)
+	for _, t := range acc.ExcludedGlobalEquivalentDomains {
+		excluded[t] = true
+	}
+
+	globals := make([]GlobalEquivalentDomains, len(GlobalDomains))
+	for i, g := range GlobalDomains {
+		globals[i] = GlobalEquivalentDomains{
+			Type:     g.Type,
+			Domains:  g.Domains,
+			Excluded: excluded[g.Type],
+		}
+	}
+
+	equivalent := acc.EquivalentDomains
+	if equivalent == nil {
+		equivalent = make([][]string, 0)
+	}
+
+	return Domains{
+		EquivalentDomains:       equivalent,
+		GlobalEquivalentDomains: globals,
+		Object:                  "domains",
+	}
+}
+
 type GlobalEquivalentDomains struct {
 	Type     int
 	Domains  []string
@@ -49,6 +78,7 @@ type Profile struct {
 	Premium            bool
 	MasterPasswordHint string
 	Culture            string
+	AvatarColor        *string
 	TwoFactorEnabled   bool
 	Key                string
 	PrivateKey         string
@@ -57,15 +87,23 @@ type Profile struct {
 	Object             string
 }
 
+// Premium reports whether the account gets premium features, the profile and
+// the access token tell clients the same. There are no subscriptions, so
+// every account does.
+func (acc Account) Premium() bool {
+	return true
+}
+
+// Profile of the account as sync and the profile endpoints return it.
 func (acc Account) Profile() Profile {
 	p := Profile{
 		Id:                 acc.Id,
 		Name:               nil,
 		Email:              acc.Email,
 		EmailVerified:      false,
-		Premium:            false,
+		Premium:            acc.Premium(),
 		MasterPasswordHint: acc.MasterPasswordHint,
-		Culture:            "en-US",
+		Culture:            acc.Culture,
 		TwoFactorEnabled:   false,
 		Key:                acc.Key,
 		PrivateKey:         acc.Keys.EncryptedPrivateKey,
@@ -74,6 +112,19 @@ func (acc Account) Profile() Profile {
 		Object:             "profile",
 	}
 
+	if acc.Name != "" {
+		p.Name = &acc.Name
+	}
+	if acc.AvatarColor != "" {
+		p.AvatarColor = &acc.AvatarColor
+	}
+	if acc.SecurityStamp != "" {
+		p.SecurityStamp = &acc.SecurityStamp
+	}
+	if p.Culture == "" {
+		p.Culture = "en-US"
+	}
+
 	return p
 }
 
@@ -87,6 +138,8 @@ type Cipher struct {
 	Favorite       bool
 	Login          Login
 	Fields         []Field
+	// Previous passwords of a login, clients add to it on password changes.
+	PasswordHistory []PasswordHistory
 
 	Edit                bool
 	Id                  string
@@ -99,6 +152,9 @@ type Cipher struct {
 	Card                Card
 	Identity            Identity
 	SecureNote          SecureNote
+
+	// Members gowarden doesn't know, like PasswordHistory or new item types.
+	Extra Extra `json:"-"`
 }
 
 type Identity struct {
@@ -121,6 +177,8 @@ type Identity struct {
 	Username       string
 	PassportNumber string
 	LicenseNumber  string
+
+	Extra Extra `json:"-"`
 }
 
 type Card struct {
@@ -131,24 +189,35 @@ type Card struct {
 	ExpMonth       string
 	ExpYear        string
 	Code           string
+
+	Extra Extra `json:"-"`
 }
 
+// ErrOutOfDate is returned for updates of a cipher that changed since the
+// client last saw it.
+var ErrOutOfDate = errors.New("cipher changed since the last known revision")
+
 // TODO maybe delete
 type CipherForUpdate struct {
-	Type           int
-	FolderId       string
-	OrganizationId string
-	Name           string
-	Notes          string
-	Favorite       bool
-	Login          Login
-	Fields         []Field
-	Card           Card
-	Identity       Identity
-	SecureNote     SecureNote
+	Type            int
+	FolderId        string
+	OrganizationId  string
+	Name            string
+	Notes           string
+	Favorite        bool
+	Login           Login
+	Fields          []Field
+	PasswordHistory []PasswordHistory
+	Card            Card
+	Identity        Identity
+	SecureNote      SecureNote
 
 	Attachments  map[string]string
 	Attachments2 map[string]Attachment
+	// RevisionDate of the cipher the client edited, nil for old clients.
+	LastKnownRevisionDate *time.Time
+
+	Extra Extra `json:"-"`
 }
 
 type Attachment struct {
@@ -201,11 +270,15 @@ type Field struct {
 	Type  int
 	Name  string
 	Value string
+
+	Extra Extra `json:"-"`
 }
 
 type Uri struct {
 	Uri   string
 	Match int
+
+	Extra Extra `json:"-"`
 }
 
 type Login struct {
@@ -214,10 +287,21 @@ type Login struct {
 	Uri      string
 	Uris     []Uri
 	Username string
+
+	Extra Extra `json:"-"`
+}
+
+type PasswordHistory struct {
+	Password     string
+	LastUsedDate time.Time
+
+	Extra Extra `json:"-"`
 }
 
 type SecureNote struct {
 	Type int
+
+	Extra Extra `json:"-"`
 }
 
 // type to handle folders's response
@@ -228,6 +312,12 @@ type Folder struct {
 	Object       string
 }
 
+// Key derivation functions clients derive the master key with.
+const (
+	KdfPBKDF2   = 0
+	KdfArgon2id = 1
+)
+
 type Account struct {
 	Id                 string `json:"id"`
 	Name               string `json:"name"`
@@ -237,8 +327,34 @@ type Account struct {
 	Key                string `json:"key"`
 	Kdf                int    `json:"kdf"`
 	KdfIterations      int    `json:"kdfiterations"`
+	KdfMemory          int    `json:"kdfMemory"`      // MiB, Argon2id only.
+	KdfParallelism     int    `json:"kdfParallelism"` // Argon2id only.
 	Keys               Keys   `json:"keys"`
 	RefreshToken       string `json:"refresh_token"`
+
+	EquivalentDomains               [][]string `json:"-"`
+	ExcludedGlobalEquivalentDomains []int      `json:"-"`
+	// Last time anything in the account's vault changed.
+	RevisionDate time.Time `json:"-"`
+	// Address the account is changing its email to and the token sent there.
+	PendingEmail      string    `json:"-"`
+	EmailToken        string    `json:"-"`
+	EmailTokenExpires time.Time `json:"-"`
+
+	Culture     string `json:"-"`
+	AvatarColor string `json:"-"` // Like #aa00ff, "" picks one from the name.
+	// Changes whenever other sessions must end, access tokens carry it.
+	SecurityStamp string `json:"-"`
+}
+
+// attachment storage used by an account, used in admin api
+type StorageUsage struct {
+	AccountId   string
+	Email       string
+	Attachments int
+	Used        int64
+	Quota       int64
+	Object      string
 }
 
 type Keys struct {
@@ -0,0 +1,195 @@
+package ds
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Extra holds the json members of an object that its struct has no field
+// for. Keeping them lets data of item types and fields newer than gowarden
+// survive saving through the server.
+type Extra map[string]json.RawMessage
+
+// requestOnly are members clients send with a cipher that describe the
+// request rather than the cipher, they are never kept.
+var requestOnly = map[string]bool{
+	"lastknownrevisiondate": true,
+	"attachments2":          true,
+	"encryptedfor":          true,
+}
+
+// knownMembers caches the lower cased member names of struct types.
+var knownMembers sync.Map
+
+func membersOf(t reflect.Type) map[string]bool {
+	if known, ok := knownMembers.Load(t); ok {
+		return known.(map[string]bool)
+	}
+
+	known := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		// encoding/json matches member names case insensitively.
+		known[strings.ToLower(name)] = true
+	}
+
+	knownMembers.Store(t, known)
+	return known
+}
+
+// unmarshalExtra decodes data into v, a pointer to a struct without json
+// methods, and returns the members v has no field for.
+func unmarshalExtra(data []byte, v interface{}) (Extra, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil || members == nil {
+		// null decodes fine into a struct but not into a map.
+		return nil, nil
+	}
+
+	known := membersOf(reflect.TypeOf(v).Elem())
+
+	var extra Extra
+	for name, value := range members {
+		lower := strings.ToLower(name)
+		if known[lower] || requestOnly[lower] {
+			continue
+		}
+		if extra == nil {
+			extra = make(Extra)
+		}
+		extra[name] = value
+	}
+
+	return extra, nil
+}
+
+// marshalExtra encodes v, a struct without json methods, with the members of extra added.
+func marshalExtra(v interface{}, extra Extra) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	more, err := json.Marshal(extra)
+	if err != nil {
+		return nil, err
+	}
+
+	// Both are objects, join "{...}" and "{...}" into "{...,...}".
+	var buf bytes.Buffer
+	buf.Grow(len(data) + len(more))
+	buf.Write(data[:len(data)-1])
+	if len(data) > 2 {
+		buf.WriteByte(',')
+	}
+	buf.Write(more[1:])
+
+	return buf.Bytes(), nil
+}
+
+func (c *Cipher) UnmarshalJSON(data []byte) (err error) {
+	type cipher Cipher
+	c.Extra, err = unmarshalExtra(data, (*cipher)(c))
+	return err
+}
+
+func (c Cipher) MarshalJSON() ([]byte, error) {
+	type cipher Cipher
+	return marshalExtra(cipher(c), c.Extra)
+}
+
+func (c *CipherForUpdate) UnmarshalJSON(data []byte) (err error) {
+	type cipherForUpdate CipherForUpdate
+	c.Extra, err = unmarshalExtra(data, (*cipherForUpdate)(c))
+	return err
+}
+
+func (l *Login) UnmarshalJSON(data []byte) (err error) {
+	type login Login
+	l.Extra, err = unmarshalExtra(data, (*login)(l))
+	return err
+}
+
+func (l Login) MarshalJSON() ([]byte, error) {
+	type login Login
+	return marshalExtra(login(l), l.Extra)
+}
+
+func (u *Uri) UnmarshalJSON(data []byte) (err error) {
+	type uri Uri
+	u.Extra, err = unmarshalExtra(data, (*uri)(u))
+	return err
+}
+
+func (u Uri) MarshalJSON() ([]byte, error) {
+	type uri Uri
+	return marshalExtra(uri(u), u.Extra)
+}
+
+func (f *Field) UnmarshalJSON(data []byte) (err error) {
+	type field Field
+	f.Extra, err = unmarshalExtra(data, (*field)(f))
+	return err
+}
+
+func (f Field) MarshalJSON() ([]byte, error) {
+	type field Field
+	return marshalExtra(field(f), f.Extra)
+}
+
+func (c *Card) UnmarshalJSON(data []byte) (err error) {
+	type card Card
+	c.Extra, err = unmarshalExtra(data, (*card)(c))
+	return err
+}
+
+func (c Card) MarshalJSON() ([]byte, error) {
+	type card Card
+	return marshalExtra(card(c), c.Extra)
+}
+
+func (i *Identity) UnmarshalJSON(data []byte) (err error) {
+	type identity Identity
+	i.Extra, err = unmarshalExtra(data, (*identity)(i))
+	return err
+}
+
+func (i Identity) MarshalJSON() ([]byte, error) {
+	type identity Identity
+	return marshalExtra(identity(i), i.Extra)
+}
+
+func (s *SecureNote) UnmarshalJSON(data []byte) (err error) {
+	type secureNote SecureNote
+	s.Extra, err = unmarshalExtra(data, (*secureNote)(s))
+	return err
+}
+
+func (s SecureNote) MarshalJSON() ([]byte, error) {
+	type secureNote SecureNote
+	return marshalExtra(secureNote(s), s.Extra)
+}
+
+func (p *PasswordHistory) UnmarshalJSON(data []byte) (err error) {
+	type passwordHistory PasswordHistory
+	p.Extra, err = unmarshalExtra(data, (*passwordHistory)(p))
+	return err
+}
+
+func (p PasswordHistory) MarshalJSON() ([]byte, error) {
+	type passwordHistory PasswordHistory
+	return marshalExtra(passwordHistory(p), p.Extra)
+}
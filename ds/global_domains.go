@@ -0,0 +1,97 @@
+package ds
+
+// GlobalDomains is the list of equivalent domain groups bitwarden ships to
+// every account, Type identifies a group so accounts can exclude it. Types
+// are the values of bitwarden's GlobalEquivalentDomainsType, there is no 67.
+var GlobalDomains = []GlobalEquivalentDomains{
+	{Type: 0, Domains: []string{"youtube.com", "google.com", "gmail.com"}},
+	{Type: 1, Domains: []string{"apple.com", "icloud.com"}},
+	{Type: 2, Domains: []string{"ameritrade.com", "tdameritrade.com"}},
+	{Type: 3, Domains: []string{"bankofamerica.com", "bofa.com", "mbna.com", "usecfo.com"}},
+	{Type: 4, Domains: []string{"sprint.com", "sprintpcs.com", "nextel.com"}},
+	{Type: 5, Domains: []string{"wellsfargo.com", "wf.com", "wellsfargoadvisors.com"}},
+	{Type: 6, Domains: []string{"mymerrill.com", "ml.com", "merrilledge.com"}},
+	{Type: 7, Domains: []string{"accountonline.com", "citi.com", "citibank.com", "citicards.com", "citibankonline.com"}},
+	{Type: 8, Domains: []string{"cnet.com", "cnettv.com", "com.com", "download.com", "news.com", "search.com", "upload.com"}},
+	{Type: 9, Domains: []string{"bananarepublic.com", "gap.com", "oldnavy.com", "piperlime.com"}},
+	{Type: 10, Domains: []string{"bing.com", "hotmail.com", "live.com", "microsoft.com", "msn.com", "passport.net", "windows.com", "microsoftonline.com", "office.com", "office365.com", "microsoftstore.com", "xbox.com", "azure.com", "windowsazure.com"}},
+	{Type: 11, Domains: []string{"ua2go.com", "ual.com", "united.com", "unitedwifi.com"}},
+	{Type: 12, Domains: []string{"overture.com", "yahoo.com"}},
+	{Type: 13, Domains: []string{"zonealarm.com", "zonelabs.com"}},
+	{Type: 14, Domains: []string{"paypal.com", "paypal-search.com"}},
+	{Type: 15, Domains: []string{"avon.com", "youravon.com"}},
+	{Type: 16, Domains: []string{"diapers.com", "soap.com", "wag.com", "yoyo.com", "beautybar.com", "casa.com", "afterschool.com", "vine.com", "bookworm.com", "look.com", "vinemarket.com"}},
+	{Type: 17, Domains: []string{"1800contacts.com", "800contacts.com"}},
+	{Type: 18, Domains: []string{"amazon.com", "amazon.ae", "amazon.ca", "amazon.co.uk", "amazon.com.au", "amazon.com.br", "amazon.com.mx", "amazon.com.tr", "amazon.de", "amazon.es", "amazon.fr", "amazon.in", "amazon.it", "amazon.nl", "amazon.pl", "amazon.sa", "amazon.se", "amazon.sg", "amazon.co.jp"}},
+	{Type: 19, Domains: []string{"cox.com", "cox.net", "coxbusiness.com"}},
+	{Type: 20, Domains: []string{"mynortonaccount.com", "norton.com"}},
+	{Type: 21, Domains: []string{"verizon.com", "verizon.net"}},
+	{Type: 22, Domains: []string{"rakuten.com", "buy.com"}},
+	{Type: 23, Domains: []string{"siriusxm.com", "sirius.com"}},
+	{Type: 24, Domains: []string{"ea.com", "origin.com", "play4free.com", "tiberiumalliance.com"}},
+	{Type: 25, Domains: []string{"37signals.com", "basecamp.com", "basecamphq.com", "highrisehq.com"}},
+	{Type: 26, Domains: []string{"steampowered.com", "steamcommunity.com", "steamgames.com"}},
+	{Type: 27, Domains: []string{"chart.io", "chartio.com"}},
+	{Type: 28, Domains: []string{"gotomeeting.com", "citrixonline.com"}},
+	{Type: 29, Domains: []string{"gogoair.com", "gogoinflight.com"}},
+	{Type: 30, Domains: []string{"mysql.com", "oracle.com"}},
+	{Type: 31, Domains: []string{"discover.com", "discovercard.com"}},
+	{Type: 32, Domains: []string{"dcu.org", "dcu-online.org"}},
+	{Type: 33, Domains: []string{"healthcare.gov", "cuidadodesalud.gov", "cms.gov"}},
+	{Type: 34, Domains: []string{"pepco.com", "pepcoholdings.com"}},
+	{Type: 35, Domains: []string{"century21.com", "21online.com"}},
+	{Type: 36, Domains: []string{"comcast.com", "comcast.net", "xfinity.com"}},
+	{Type: 37, Domains: []string{"cricketwireless.com", "aiowireless.com"}},
+	{Type: 38, Domains: []string{"mandtbank.com", "mtb.com"}},
+	{Type: 39, Domains: []string{"dropbox.com", "getdropbox.com"}},
+	{Type: 40, Domains: []string{"snapfish.com", "snapfish.ca"}},
+	{Type: 41, Domains: []string{"alibaba.com", "aliexpress.com", "aliyun.com", "net.cn"}},
+	{Type: 42, Domains: []string{"playstation.com", "sonyentertainmentnetwork.com"}},
+	{Type: 43, Domains: []string{"mercadolivre.com", "mercadolivre.com.br", "mercadolibre.com", "mercadolibre.com.ar", "mercadolibre.com.mx"}},
+	{Type: 44, Domains: []string{"zendesk.com", "zopim.com"}},
+	{Type: 45, Domains: []string{"autodesk.com", "tinkercad.com"}},
+	{Type: 46, Domains: []string{"railnation.ru", "railnation.de", "rail-nation.com", "railnation.gr", "railnation.us", "trucknation.de", "traviangames.com"}},
+	{Type: 47, Domains: []string{"wpcu.coop", "wpcuonline.com"}},
+	{Type: 48, Domains: []string{"mathletics.com", "mathletics.com.au", "mathletics.co.uk"}},
+	{Type: 49, Domains: []string{"discountbank.co.il", "telebank.co.il"}},
+	{Type: 50, Domains: []string{"mi.com", "xiaomi.com"}},
+	{Type: 51, Domains: []string{"facebook.com", "messenger.com"}},
+	{Type: 52, Domains: []string{"postepay.it", "poste.it"}},
+	{Type: 53, Domains: []string{"skysports.com", "skybet.com", "skyvegas.com"}},
+	{Type: 54, Domains: []string{"disneymoviesanywhere.com", "go.com", "disney.com", "dadt.com", "disneyplus.com"}},
+	{Type: 55, Domains: []string{"pokemon-gl.com", "pokemon.com"}},
+	{Type: 56, Domains: []string{"myuv.com", "uvvu.com"}},
+	{Type: 57, Domains: []string{"bank-yahav.co.il", "bankhapoalim.co.il"}},
+	{Type: 58, Domains: []string{"mdsol.com", "imedidata.com"}},
+	{Type: 59, Domains: []string{"sears.com", "shld.net"}},
+	{Type: 60, Domains: []string{"xiami.com", "alipay.com"}},
+	{Type: 61, Domains: []string{"belkin.com", "seedonk.com"}},
+	{Type: 62, Domains: []string{"turbotax.com", "intuit.com"}},
+	{Type: 63, Domains: []string{"shopify.com", "myshopify.com"}},
+	{Type: 64, Domains: []string{"ebay.com", "ebay.at", "ebay.be", "ebay.ca", "ebay.ch", "ebay.cn", "ebay.co.jp", "ebay.co.th", "ebay.co.uk", "ebay.com.au", "ebay.com.hk", "ebay.com.my", "ebay.com.sg", "ebay.com.tw", "ebay.de", "ebay.es", "ebay.fr", "ebay.ie", "ebay.in", "ebay.it", "ebay.nl", "ebay.ph", "ebay.pl"}},
+	{Type: 65, Domains: []string{"techdata.com", "techdata.ch"}},
+	{Type: 66, Domains: []string{"schwab.com", "schwabplan.com"}},
+	{Type: 68, Domains: []string{"tesla.com", "teslamotors.com"}},
+	{Type: 69, Domains: []string{"morganstanley.com", "morganstanleyclientserv.com", "stockplanconnect.com", "ms.com"}},
+	{Type: 70, Domains: []string{"taxact.com", "taxactonline.com"}},
+	{Type: 71, Domains: []string{"mediawiki.org", "wikibooks.org", "wikidata.org", "wikimedia.org", "wikinews.org", "wikipedia.org", "wikiquote.org", "wikisource.org", "wikiversity.org", "wikivoyage.org", "wiktionary.org"}},
+	{Type: 72, Domains: []string{"airbnb.at", "airbnb.be", "airbnb.ca", "airbnb.ch", "airbnb.cl", "airbnb.co.cr", "airbnb.co.id", "airbnb.co.in", "airbnb.co.kr", "airbnb.co.nz", "airbnb.co.uk", "airbnb.co.ve", "airbnb.com", "airbnb.com.ar", "airbnb.com.au", "airbnb.com.bo", "airbnb.com.br", "airbnb.com.bz", "airbnb.com.co", "airbnb.com.ec", "airbnb.com.gt", "airbnb.com.hk", "airbnb.com.hn", "airbnb.com.mt", "airbnb.com.my", "airbnb.com.ni", "airbnb.com.pa", "airbnb.com.pe", "airbnb.com.py", "airbnb.com.sg", "airbnb.com.sv", "airbnb.com.tr", "airbnb.com.tw", "airbnb.cz", "airbnb.de", "airbnb.dk", "airbnb.es", "airbnb.fi", "airbnb.fr", "airbnb.gr", "airbnb.gy", "airbnb.hu", "airbnb.ie", "airbnb.is", "airbnb.it", "airbnb.jp", "airbnb.mx", "airbnb.nl", "airbnb.no", "airbnb.pl", "airbnb.pt", "airbnb.ru", "airbnb.se"}},
+	{Type: 73, Domains: []string{"eventbrite.at", "eventbrite.be", "eventbrite.ca", "eventbrite.ch", "eventbrite.cl", "eventbrite.co", "eventbrite.co.nz", "eventbrite.co.uk", "eventbrite.com", "eventbrite.com.ar", "eventbrite.com.au", "eventbrite.com.br", "eventbrite.com.mx", "eventbrite.com.pe", "eventbrite.de", "eventbrite.dk", "eventbrite.es", "eventbrite.fi", "eventbrite.fr", "eventbrite.hk", "eventbrite.ie", "eventbrite.it", "eventbrite.nl", "eventbrite.pt", "eventbrite.se", "eventbrite.sg"}},
+	{Type: 74, Domains: []string{"stackexchange.com", "superuser.com", "stackoverflow.com", "serverfault.com", "mathoverflow.net", "askubuntu.com", "stackapps.com"}},
+	{Type: 75, Domains: []string{"docusign.com", "docusign.net"}},
+	{Type: 76, Domains: []string{"envato.com", "themeforest.net", "codecanyon.net", "videohive.net", "audiojungle.net", "graphicriver.net", "photodune.net", "3docean.net"}},
+	{Type: 77, Domains: []string{"x10hosting.com", "x10premium.com"}},
+	{Type: 78, Domains: []string{"dnsomatic.com", "opendns.com", "umbrella.com"}},
+	{Type: 79, Domains: []string{"cagreatamerica.com", "canadaswonderland.com", "carowinds.com", "cedarfair.com", "cedarpoint.com", "dorneypark.com", "kingsdominion.com", "knotts.com", "miadventure.com", "schlitterbahn.com", "valleyfair.com", "visitkingsisland.com", "worldsoffun.com"}},
+	{Type: 80, Domains: []string{"ubnt.com", "ui.com"}},
+	{Type: 81, Domains: []string{"discordapp.com", "discord.com"}},
+	{Type: 82, Domains: []string{"netcup.de", "netcup.eu", "customercontrolpanel.de"}},
+	{Type: 83, Domains: []string{"yandex.com", "ya.ru", "yandex.az", "yandex.by", "yandex.co.il", "yandex.com.am", "yandex.com.ge", "yandex.com.tr", "yandex.ee", "yandex.fi", "yandex.fr", "yandex.kg", "yandex.kz", "yandex.lt", "yandex.lv", "yandex.md", "yandex.pl", "yandex.ru", "yandex.tj", "yandex.tm", "yandex.ua", "yandex.uz"}},
+	{Type: 84, Domains: []string{"sonyentertainmentnetwork.com", "sony.com"}},
+	{Type: 85, Domains: []string{"proton.me", "protonmail.com", "protonvpn.com"}},
+	{Type: 86, Domains: []string{"ubisoft.com", "ubi.com"}},
+	{Type: 87, Domains: []string{"transferwise.com", "wise.com"}},
+	{Type: 88, Domains: []string{"takeaway.com", "just-eat.dk", "just-eat.no", "just-eat.fr", "just-eat.ch", "lieferando.de", "lieferando.at", "thuisbezorgd.nl", "pyszne.pl"}},
+	{Type: 89, Domains: []string{"atlassian.com", "bitbucket.org", "trello.com", "statuspage.io", "atlassian.net", "jira.com"}},
+	{Type: 90, Domains: []string{"pinterest.com", "pinterest.com.au", "pinterest.cl", "pinterest.de", "pinterest.dk", "pinterest.es", "pinterest.fr", "pinterest.co.uk", "pinterest.jp", "pinterest.co.kr", "pinterest.nz", "pinterest.pt", "pinterest.se"}},
+}
@@ -0,0 +1,291 @@
+package favicon
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	iconSuffix = ".icon.png"
+	missSuffix = ".miss"
+	tmpPrefix  = ".tmp-"
+	// Accounted on top of the file size so misses and tiny icons aren't free.
+	entryOverhead = 256
+)
+
+// Cached is an icon read from the cache.
+type Cached struct {
+	Data    []byte
+	ModTime time.Time
+	ETag    string
+}
+
+type entry struct {
+	name    string // File name in the cache directory.
+	size    int64
+	modTime time.Time
+}
+
+// Cache keeps fetched icons in a directory, one file per domain. Domains
+// without an icon get an empty ".miss" file so they aren't fetched again and
+// again. Entries expire after their ttl based on the file's modification
+// time, and the least recently used entries are evicted once the cache grows
+// over maxSize bytes.
+type Cache struct {
+	dir         string
+	maxSize     int64
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Most recently used entry in front.
+	entries map[string]*list.Element
+}
+
+// NewCache opens the cache in dir, indexing the files already there. A
+// maxSize of 0 means unlimited.
+func NewCache(dir string, maxSize int64, ttl, negativeTTL time.Duration) (*Cache, error) {
+	c := &Cache{
+		dir:         dir,
+		maxSize:     maxSize,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without access times the oldest files are the best guess for least
+	// used. Oldest first, as every add pushes to the front.
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+
+	for _, info := range infos {
+		name := info.Name()
+		switch {
+		case !info.Mode().IsRegular():
+			continue
+		case strings.HasPrefix(name, tmpPrefix),
+			strings.HasSuffix(name, iconSuffix) && info.Size() == 0:
+			// Leftovers of interrupted or failed downloads.
+			os.Remove(filepath.Join(dir, name))
+		case strings.HasSuffix(name, iconSuffix), strings.HasSuffix(name, missSuffix):
+			c.add(name, info.Size(), info.ModTime())
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict()
+
+	return c, nil
+}
+
+// Get returns the cached icon of domain. found is false if nothing fresh is
+// cached, a fresh negative entry returns ErrNotFound.
+func (c *Cache) Get(domain string) (icon Cached, found bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.touch(domain + missSuffix); ok && time.Since(e.modTime) < c.negativeTTL {
+		return Cached{}, true, ErrNotFound
+	}
+
+	e, ok := c.touch(domain + iconSuffix)
+	if !ok || time.Since(e.modTime) >= c.ttl {
+		return Cached{}, false, nil
+	}
+
+	icon, err = c.read(e)
+	if err != nil {
+		return Cached{}, false, err
+	}
+	return icon, true, nil
+}
+
+// Stale returns the cached icon of domain even if it expired, used when a
+// refresh fails. The icon then counts as fresh for the negative ttl, so a
+// site that is down isn't fetched again on every request.
+func (c *Cache) Stale(domain string) (Cached, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.touch(domain + iconSuffix)
+	if !ok {
+		return Cached{}, ErrNotFound
+	}
+
+	icon, err := c.read(e)
+	if err != nil {
+		return Cached{}, err
+	}
+
+	if modTime := time.Now().Add(c.negativeTTL - c.ttl); modTime.After(e.modTime) {
+		if err = os.Chtimes(filepath.Join(c.dir, e.name), modTime, modTime); err != nil {
+			return Cached{}, err
+		}
+		e.modTime = modTime
+	}
+	return icon, nil
+}
+
+// Put caches icon for domain.
+func (c *Cache) Put(domain string, icon []byte) (Cached, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(domain + missSuffix)
+
+	e, err := c.write(domain+iconSuffix, icon)
+	if err != nil {
+		return Cached{}, err
+	}
+	return Cached{Data: icon, ModTime: e.modTime, ETag: etag(icon)}, nil
+}
+
+// PutMiss remembers that domain has no icon.
+func (c *Cache) PutMiss(domain string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.write(domain+missSuffix, nil)
+	return err
+}
+
+// Purge removes domain from the cache, or everything if domain is "". It
+// returns the number of removed entries.
+func (c *Cache) Purge(domain string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var names []string
+	if domain == "" {
+		for name := range c.entries {
+			names = append(names, name)
+		}
+	} else {
+		names = []string{domain + iconSuffix, domain + missSuffix}
+	}
+
+	n := 0
+	for _, name := range names {
+		if _, ok := c.entries[name]; !ok {
+			continue
+		}
+		if err := c.remove(name); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Size returns the bytes accounted to the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// write atomically replaces name with data through a temp file, so readers
+// never see half written icons.
+func (c *Cache) write(name string, data []byte) (*entry, error) {
+	tmp, err := ioutil.TempFile(c.dir, tmpPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(c.dir, name)); err != nil {
+		return nil, err
+	}
+
+	c.forget(name)
+	e := c.add(name, int64(len(data)), time.Now())
+	c.evict()
+	return e, nil
+}
+
+func (c *Cache) read(e *entry) (Cached, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, e.name))
+	if os.IsNotExist(err) {
+		// Removed behind our back.
+		c.forget(e.name)
+		return Cached{}, ErrNotFound
+	}
+	if err != nil {
+		return Cached{}, err
+	}
+	return Cached{Data: data, ModTime: e.modTime, ETag: etag(data)}, nil
+}
+
+// add indexes name as the most recently used entry. Callers must hold c.mu,
+// except while NewCache builds the index.
+func (c *Cache) add(name string, size int64, modTime time.Time) *entry {
+	e := &entry{name: name, size: size, modTime: modTime}
+	c.entries[name] = c.lru.PushFront(e)
+	c.size += size + entryOverhead
+	return e
+}
+
+// touch marks name as recently used.
+func (c *Cache) touch(name string) (*entry, bool) {
+	el, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*entry), true
+}
+
+// forget drops name from the index without touching the file.
+func (c *Cache) forget(name string) {
+	el, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.size -= el.Value.(*entry).size + entryOverhead
+	c.lru.Remove(el)
+	delete(c.entries, name)
+}
+
+func (c *Cache) remove(name string) error {
+	c.forget(name)
+	err := os.Remove(filepath.Join(c.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// evict removes least recently used entries until the cache fits maxSize.
+func (c *Cache) evict() {
+	for c.maxSize > 0 && c.size > c.maxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*entry).name)
+	}
+}
+
+func etag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
@@ -0,0 +1,62 @@
+// Package favicon fetches and caches the icons shown next to vault items.
+package favicon
+
+import (
+	"strings"
+)
+
+// Service answers icon requests from the cache, fetching missing icons.
+type Service struct {
+	fetcher *Fetcher
+	cache   *Cache
+}
+
+func New(fetcher *Fetcher, cache *Cache) *Service {
+	return &Service{
+		fetcher: fetcher,
+		cache:   cache,
+	}
+}
+
+// Icon returns the icon of domain, or ErrNotFound if the site has none.
+func (s *Service) Icon(domain string) (Icon, error) {
+	domain = strings.ToLower(domain)
+
+	cached, found, err := s.cache.Get(domain)
+	if found {
+		if err != nil {
+			return Icon{}, err
+		}
+		return cachedIcon(cached), nil
+	}
+
+	icon, err := s.fetcher.Fetch(domain)
+	switch err {
+	case nil:
+		cached, err = s.cache.Put(domain, icon.Data)
+		if err != nil {
+			return Icon{}, err
+		}
+		return cachedIcon(cached), nil
+	case ErrNotFound:
+		// Keep showing the old icon if the site is just down for now.
+		if stale, staleErr := s.cache.Stale(domain); staleErr == nil {
+			return cachedIcon(stale), nil
+		}
+		if err := s.cache.PutMiss(domain); err != nil {
+			return Icon{}, err
+		}
+		return Icon{}, ErrNotFound
+	default:
+		return Icon{}, err
+	}
+}
+
+func cachedIcon(cached Cached) Icon {
+	return Icon{
+		Data:        cached.Data,
+		ContentType: sniff(cached.Data),
+		ModTime:     cached.ModTime,
+		ETag:        cached.ETag,
+	}
+}
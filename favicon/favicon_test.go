@@ -0,0 +1,284 @@
+package favicon
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	png = []byte("\x89PNG\r\n\x1a\nsmall")
+	ico = []byte("\x00\x00\x01\x00favicon")
+)
+
+func testFetcher() *Fetcher {
+	f := NewFetcher(5 * time.Second)
+	f.allowPrivate = true
+	return f
+}
+
+func TestFetchBestIcon(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><head>
+<link rel="apple-touch-icon" href="/apple.png">
+<link rel="icon" type="image/svg+xml" href="/icon.svg">
+<link rel='icon' sizes="16x16" href="/16.png">
+<link href="/static/32.png?v=1&amp;x=2" sizes="32x32" rel="shortcut icon">
+</head></html>`))
+	})
+	mux.HandleFunc("/static/32.png", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("x") != "2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(png)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	icon, err := testFetcher().Fetch(host(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(icon.Data) != string(png) || icon.ContentType != "image/png" {
+		t.Errorf("Got %q as %v", icon.Data, icon.ContentType)
+	}
+}
+
+func TestFetchFallback(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<link rel="icon" href="/not-an-image.png">`))
+	})
+	mux.HandleFunc("/not-an-image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>404</html>"))
+	})
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ico)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	icon, err := testFetcher().Fetch(host(srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if icon.ContentType != "image/x-icon" {
+		t.Errorf("Got %v, want the favicon.ico fallback", icon.ContentType)
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(ico)
+	}))
+	defer srv.Close()
+
+	_, err := NewFetcher(time.Second).Fetch(host(srv))
+	if err != ErrNotFound {
+		t.Errorf("Fetch from loopback returned %v, want ErrNotFound", err)
+	}
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "169.254.169.254", "::1", "fd00::1"} {
+		if !blockedIP(net.ParseIP(ip)) {
+			t.Errorf("%v is not blocked", ip)
+		}
+	}
+	if blockedIP(net.ParseIP("93.184.216.34")) {
+		t.Error("Public address is blocked")
+	}
+}
+
+func TestServiceCachesMisses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	cache, err := NewCache(dir, 0, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(testFetcher(), cache)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Icon(host(srv)); err != ErrNotFound {
+			t.Fatalf("Icon returned %v, want ErrNotFound", err)
+		}
+	}
+	// The home page and /favicon.ico, once.
+	if hits != 2 {
+		t.Errorf("Site was hit %v times, the miss should have been cached", hits)
+	}
+}
+
+func TestServiceKeepsStaleIcon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	down, hits := false, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		if down || r.URL.Path != "/favicon.ico" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(png)
+	}))
+	defer srv.Close()
+
+	cache, err := NewCache(dir, 0, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(testFetcher(), cache)
+	if _, err = s.Icon(host(srv)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	down, hits = true, 0
+	for i := 0; i < 2; i++ {
+		icon, err := s.Icon(host(srv))
+		if err != nil || string(icon.Data) != string(png) {
+			t.Fatalf("Icon returned %q, %v, want the stale icon", icon.Data, err)
+		}
+	}
+	// The home page and /favicon.ico, once.
+	if hits != 2 {
+		t.Errorf("Site was hit %v times, the stale icon should have been kept", hits)
+	}
+}
+
+func host(srv *httptest.Server) string {
+	u, _ := url.Parse(srv.URL)
+	return u.Host
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Leftovers a crashed download may leave behind.
+	ioutil.WriteFile(filepath.Join(dir, tmpPrefix+"123"), png, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "empty.com"+iconSuffix), nil, 0644)
+
+	icon := make([]byte, 1000)
+	cache, err := NewCache(dir, 2*(1000+entryOverhead), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.Size() != 0 {
+		t.Errorf("Leftovers were indexed, size is %v", cache.Size())
+	}
+
+	cache.Put("a.com", icon)
+	cache.Put("b.com", icon)
+	// Use a.com so b.com becomes the least recently used.
+	if _, found, _ := cache.Get("a.com"); !found {
+		t.Fatal("a.com is not cached")
+	}
+	cache.Put("c.com", icon)
+
+	for domain, want := range map[string]bool{"a.com": true, "b.com": false, "c.com": true} {
+		if _, found, _ := cache.Get(domain); found != want {
+			t.Errorf("%v cached: %v, want %v", domain, found, want)
+		}
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("%v files left in the cache directory, want 2", len(files))
+	}
+
+	// A reopened cache sees the same entries.
+	cache, err = NewCache(dir, 0, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := cache.Purge(""); n != 2 {
+		t.Errorf("Purged %v entries, want 2", n)
+	}
+	if cache.Size() != 0 {
+		t.Errorf("Size after purge is %v", cache.Size())
+	}
+}
+
+func TestCacheEvictionAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files of an earlier run, a.com the oldest.
+	now := time.Now()
+	for i, domain := range []string{"a.com", "b.com", "c.com"} {
+		name := filepath.Join(dir, domain+iconSuffix)
+		ioutil.WriteFile(name, png, 0644)
+		modTime := now.Add(time.Duration(i-3) * time.Minute)
+		os.Chtimes(name, modTime, modTime)
+	}
+
+	cache, err := NewCache(dir, 2*(int64(len(png))+entryOverhead), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Over the limit again, the oldest of the rest goes.
+	cache.Put("d.com", png)
+
+	for domain, want := range map[string]bool{"a.com": false, "b.com": false, "c.com": true, "d.com": true} {
+		if _, found, _ := cache.Get(domain); found != want {
+			t.Errorf("%v cached: %v, want %v", domain, found, want)
+		}
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(dir, 0, time.Millisecond, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := cache.Put("a.com", png)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.ETag == "" || cached.ModTime.IsZero() {
+		t.Errorf("Missing ETag or ModTime: %+v", cached)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if _, found, _ := cache.Get("a.com"); found {
+		t.Error("Expired icon is still fresh")
+	}
+	if stale, err := cache.Stale("a.com"); err != nil || string(stale.Data) != string(png) {
+		t.Errorf("Stale returned %q, %v", stale.Data, err)
+	}
+}
@@ -0,0 +1,321 @@
+package favicon
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	maxPageSize = 1 << 20   // Only the head of a page is needed to find icons.
+	maxIconSize = 512 << 10 // Icons are tiny, anything bigger is not an icon.
+	userAgent   = "Mozilla/5.0 (compatible; gowarden favicon fetcher)"
+)
+
+// ErrNotFound is returned when a site has no usable icon.
+var ErrNotFound = errors.New("icon not found")
+
+var (
+	validDomain = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]{1,5})?$`)
+	linkTag     = regexp.MustCompile(`(?is)<(link|base)\s[^>]*>`)
+	attribute   = regexp.MustCompile(`(?s)([a-zA-Z-]+)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// Addresses icons must never be fetched from, see blockedIP.
+var blockedNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// blockedIP reports whether ip is loopback, private or otherwise not public.
+func blockedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Icon is a downloaded and validated icon.
+type Icon struct {
+	Data        []byte
+	ContentType string
+	// Set by Service from the cache entry.
+	ModTime time.Time
+	ETag    string
+}
+
+// Fetcher downloads the icon of a site straight from the site.
+type Fetcher struct {
+	client *http.Client
+	// allowPrivate disables the SSRF protection, only tests set it.
+	allowPrivate bool
+}
+
+func NewFetcher(timeout time.Duration) *Fetcher {
+	f := &Fetcher{}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// Check the address actually dialed, so DNS can't point us to internal hosts.
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); !f.allowPrivate && (ip == nil || blockedIP(ip)) {
+				return errors.New("refusing to fetch icon from non public address " + host)
+			}
+			return nil
+		},
+	}
+
+	f.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}
+
+	return f
+}
+
+// ValidDomain reports whether domain looks like a host name, optionally with a port.
+func ValidDomain(domain string) bool {
+	return len(domain) <= 255 && validDomain.MatchString(domain)
+}
+
+// Fetch finds the best icon of domain. It reads the icons the home page links
+// to and falls back to /favicon.ico, returning ErrNotFound if nothing valid is found.
+func (f *Fetcher) Fetch(domain string) (Icon, error) {
+	if !ValidDomain(domain) {
+		return Icon{}, errors.New("invalid domain: " + domain)
+	}
+
+	var candidates []candidate
+	var base *url.URL
+
+	for _, scheme := range []string{"https", "http"} {
+		page, err := url.Parse(scheme + "://" + domain + "/")
+		if err != nil {
+			return Icon{}, err
+		}
+
+		// Even if the home page errors the site may still serve /favicon.ico.
+		final, body, err := f.get(page.String(), maxPageSize)
+		if final == nil {
+			continue
+		}
+
+		base = final
+		if err == nil {
+			candidates = findIcons(final, body)
+		}
+		break
+	}
+
+	if base == nil {
+		return Icon{}, ErrNotFound
+	}
+
+	fallback, _ := base.Parse("/favicon.ico")
+	candidates = append(candidates, candidate{url: fallback.String(), score: fallbackScore})
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score < candidates[j].score })
+
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		if seen[c.url] {
+			continue
+		}
+		seen[c.url] = true
+
+		// Read one byte more than allowed to spot icons that are too big.
+		_, data, err := f.get(c.url, maxIconSize+1)
+		if err != nil || len(data) > maxIconSize {
+			continue
+		}
+
+		if contentType := sniff(data); contentType != "" {
+			return Icon{Data: data, ContentType: contentType}, nil
+		}
+	}
+
+	return Icon{}, ErrNotFound
+}
+
+// get downloads rawurl, returning the url after redirects and at most limit
+// bytes of the body. The url is also returned if the site answered with an error.
+func (f *Fetcher) get(rawurl string, limit int64) (*url.URL, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return res.Request.URL, nil, errors.New("unexpected status " + res.Status + " for " + rawurl)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, limit))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res.Request.URL, body, nil
+}
+
+type candidate struct {
+	url   string
+	score int // Lower is better.
+}
+
+const fallbackScore = 50
+
+// findIcons returns the icons page links to, resolved against its url.
+func findIcons(page *url.URL, body []byte) []candidate {
+	var candidates []candidate
+	base := page
+
+	for _, tag := range linkTag.FindAll(body, -1) {
+		attrs := map[string]string{}
+		for _, m := range attribute.FindAllSubmatch(tag, -1) {
+			attrs[strings.ToLower(string(m[1]))] = html.UnescapeString(strings.Trim(string(m[2]), `"'`))
+		}
+
+		if bytes.HasPrefix(bytes.ToLower(tag), []byte("<base")) {
+			if u, err := page.Parse(attrs["href"]); err == nil && attrs["href"] != "" {
+				base = u
+			}
+			continue
+		}
+
+		rel := strings.ToLower(attrs["rel"])
+		href := strings.TrimSpace(attrs["href"])
+		if !strings.Contains(rel, "icon") || strings.Contains(rel, "mask-icon") || href == "" {
+			continue
+		}
+
+		u, err := base.Parse(href)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(u.Path), ".svg") || strings.Contains(attrs["type"], "svg") {
+			// Clients can't show svg icons.
+			continue
+		}
+
+		candidates = append(candidates, candidate{url: u.String(), score: score(rel, attrs["sizes"])})
+	}
+
+	return candidates
+}
+
+// score ranks an icon by its declared size, preferring 32x32 which is what
+// clients show, then a bit bigger, then smaller or unknown sizes.
+func score(rel, sizes string) int {
+	size := 0
+	for _, s := range strings.Fields(strings.ToLower(sizes)) {
+		wh := strings.SplitN(s, "x", 2)
+		if n, err := strconv.Atoi(wh[0]); err == nil && n > size {
+			size = n
+		}
+	}
+
+	var s int
+	switch {
+	case size == 32:
+		s = 1
+	case size == 64:
+		s = 2
+	case size >= 24 && size <= 128:
+		s = 3
+	case size == 16:
+		s = 4
+	case size == 0:
+		s = 5
+	default:
+		s = 6
+	}
+
+	if strings.Contains(rel, "apple-touch-icon") {
+		s += 10
+	}
+
+	return s
+}
+
+// sniff returns the content type of supported image formats, "" for anything else.
+func sniff(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte("\x00\x00\x01\x00")):
+		return "image/x-icon"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "image/jpeg"
+	case len(data) > 12 && bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "image/webp"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "image/bmp"
+	default:
+		return ""
+	}
+}
@@ -8,8 +8,6 @@ require (
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.4
 	github.com/mattn/go-sqlite3 v2.0.3+incompatible
-	github.com/sirupsen/logrus v1.5.0
 	go.uber.org/zap v1.14.1
-	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
-	golang.org/x/tools v0.0.0-20191029190741-b9c20aec41a5
+	golang.org/x/crypto v0.1.0
 )
@@ -2,22 +2,28 @@ package main
 
 import (
 	"encoding/csv"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/404cn/gowarden/ds"
+	"github.com/404cn/gowarden/favicon"
 	"github.com/404cn/gowarden/logger"
 	"github.com/404cn/gowarden/utils"
 
 	"github.com/404cn/gowarden/api"
+	"github.com/404cn/gowarden/server"
 	"github.com/404cn/gowarden/sqlite"
+	"github.com/404cn/gowarden/storage"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/sirupsen/logrus"
 )
 
 var gowarden struct {
@@ -28,17 +34,34 @@ var gowarden struct {
 	secretKey           string
 	logLevel            int
 	disableFavicon      bool
-	faviconProxyServer  string
+	iconCacheTTL        time.Duration
+	iconNegativeTTL     time.Duration
+	iconCacheSize       int64
 	enableHttps         bool
 	cert                string
 	key                 string
 	csvFile             string
 	username            string
+	storage             string
+	s3                  storage.S3Config
+	maxAttachmentSize   int64
+	storageQuota        int64
+	adminToken          string
+	logEmailTokens      bool
+	passwordHash        string
+	passwordIterations  int
+	passwordMemory      int
+	passwordParallelism int
+	bind                string
+	acmeDomains         string
+	domain              string
+	trustedProxies      string
+	server              server.Config
 }
 
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	flag.BoolVar(&gowarden.initDB, "initDB", false, "Initalizes the database.")
+	flag.BoolVar(&gowarden.initDB, "initDB", false, "Delete the existing database and create an empty one.")
 	flag.StringVar(&gowarden.dir, "d", "", "Set the directory.")
 	flag.StringVar(&gowarden.port, "p", "9527", "Set the Port.")
 	flag.BoolVar(&gowarden.disableRegistration, "disableRegistration", false, "Disable registration.")
@@ -46,19 +69,61 @@ func init() {
 	// TODO set level to info
 	flag.IntVar(&gowarden.logLevel, "loglevel", -1, "Set log level, default is info.")
 	flag.BoolVar(&gowarden.disableFavicon, "disableFavicon", false, "Disable favicon server.")
-	// TODO change default to empty.
-	flag.StringVar(&gowarden.faviconProxyServer, "faviconProxyServer", "http://127.0.0.1:7890", "Set favicon's proxy server.")
+	flag.DurationVar(&gowarden.iconCacheTTL, "iconCacheTTL", 7*24*time.Hour, "How long to cache icons before fetching them again.")
+	flag.DurationVar(&gowarden.iconNegativeTTL, "iconNegativeTTL", 3*24*time.Hour, "How long to remember sites without an icon.")
+	flag.Int64Var(&gowarden.iconCacheSize, "iconCacheSize", 50<<20, "Max size of the icon cache in bytes, 0 means unlimited.")
 	flag.BoolVar(&gowarden.enableHttps, "enableHttps", false, "Set true to enable https.")
 	flag.StringVar(&gowarden.cert, "certFile", "", "Path to cert.pem file")
 	flag.StringVar(&gowarden.key, "keyFile", "", "Path to key.pem file.")
+	flag.DurationVar(&gowarden.server.CertCheckInterval, "certCheckInterval", server.DefaultConfig.CertCheckInterval, "How often to check -certFile and -keyFile for changes, 0 means only on SIGHUP.")
+	flag.StringVar(&gowarden.acmeDomains, "acmeDomains", "", "Comma separated domains to get certificates for with ACME, enables https.")
+	flag.StringVar(&gowarden.server.ACMECacheDir, "acmeCacheDir", "acme", "Where to keep ACME certificates and the account key.")
+	flag.StringVar(&gowarden.server.ACMEEmail, "acmeEmail", "", "Contact email of the ACME account.")
+	flag.StringVar(&gowarden.server.ACMEDirectoryURL, "acmeDirectory", "", "ACME directory url, empty for Let's Encrypt, https://localhost:14000/dir for a local Pebble.")
+	flag.StringVar(&gowarden.server.ACMECARoots, "acmeCARoots", "", "PEM file of CAs to trust when talking to the ACME CA, like Pebble's.")
+	flag.StringVar(&gowarden.server.RedirectAddr, "redirectAddr", "", "Address of a http listener redirecting to https like :80, needed for ACME http-01 challenges.")
 	flag.StringVar(&gowarden.csvFile, "csvFile", "", "Path to csv file.")
 	// TODO change to default value
 	flag.StringVar(&gowarden.username, "username or email", "", "Only use with --csvFile to decide import data from csv to which account")
+	flag.StringVar(&gowarden.storage, "storage", "fs", "Where to store attachments, fs or s3.")
+	flag.StringVar(&gowarden.s3.Endpoint, "s3Endpoint", "https://s3.amazonaws.com", "S3 compatible endpoint, e.g. http://127.0.0.1:9000 for minio.")
+	flag.StringVar(&gowarden.s3.Region, "s3Region", "us-east-1", "S3 region.")
+	flag.StringVar(&gowarden.s3.Bucket, "s3Bucket", "", "S3 bucket to store attachments in.")
+	flag.StringVar(&gowarden.s3.AccessKey, "s3AccessKey", "", "S3 access key.")
+	flag.StringVar(&gowarden.s3.SecretKey, "s3SecretKey", "", "S3 secret key.")
+	flag.BoolVar(&gowarden.s3.PathStyle, "s3PathStyle", false, "Use path style bucket urls, needed by minio.")
+	flag.Int64Var(&gowarden.maxAttachmentSize, "maxAttachmentSize", 100<<20, "Max size of one attachment in bytes, 0 means unlimited.")
+	flag.Int64Var(&gowarden.storageQuota, "storageQuota", 1<<30, "Max attachment storage of one account in bytes, 0 means unlimited.")
+	flag.StringVar(&gowarden.adminToken, "adminToken", "", "Token to access the admin api, admin api is disabled if empty.")
+	flag.BoolVar(&gowarden.logEmailTokens, "logEmailTokens", false, "Allow email changes by logging the tokens verifying new addresses, gowarden can't send emails so the admin has to pass them on.")
+	flag.StringVar(&gowarden.passwordHash, "passwordHash", "argon2id", "How to hash master passwords on the server, argon2id or pbkdf2.")
+	flag.IntVar(&gowarden.passwordIterations, "passwordIterations", 0, "Time cost of argon2id or iterations of pbkdf2, 0 means the default.")
+	flag.IntVar(&gowarden.passwordMemory, "passwordMemory", 0, "Memory of argon2id in KiB, 0 means the default.")
+	flag.IntVar(&gowarden.passwordParallelism, "passwordParallelism", 0, "Parallelism of argon2id, 0 means the default.")
+	flag.StringVar(&gowarden.bind, "bind", "127.0.0.1", "Address to listen on, 0.0.0.0 for every interface.")
+	flag.StringVar(&gowarden.domain, "domain", "", "Public url of gowarden like https://example.com/vault, its path is where every route is served.")
+	flag.StringVar(&gowarden.trustedProxies, "trustedProxies", "", "Comma separated addresses or networks of reverse proxies whose X-Forwarded-* headers are trusted, like 127.0.0.1,10.0.0.0/8.")
+	flag.StringVar(&gowarden.server.Socket, "socket", "", "Listen on this unix socket instead of -bind and -p.")
+	flag.DurationVar(&gowarden.server.ReadHeaderTimeout, "readHeaderTimeout", server.DefaultConfig.ReadHeaderTimeout, "Max time to read request headers.")
+	flag.DurationVar(&gowarden.server.ReadTimeout, "readTimeout", server.DefaultConfig.ReadTimeout, "Max time to read a whole request, 0 means unlimited.")
+	flag.DurationVar(&gowarden.server.WriteTimeout, "writeTimeout", server.DefaultConfig.WriteTimeout, "Max time to write a response, 0 means unlimited.")
+	flag.DurationVar(&gowarden.server.IdleTimeout, "idleTimeout", server.DefaultConfig.IdleTimeout, "How long to keep idle connections open.")
+	flag.DurationVar(&gowarden.server.ShutdownTimeout, "shutdownTimeout", server.DefaultConfig.ShutdownTimeout, "How long to wait for running requests on shutdown.")
+	flag.Int64Var(&gowarden.server.MaxBodySize, "maxBodySize", server.DefaultConfig.MaxBodySize, "Max size of a request body in bytes, 0 means unlimited.")
+	flag.Int64Var(&gowarden.server.MaxUploadSize, "maxUploadSize", 0, "Max size of an attachment upload request in bytes, 0 leaves it to -maxAttachmentSize.")
 }
 
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "icons" {
+		err := iconsCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	sugar, err := logger.New(gowarden.logLevel)
 	if err != nil {
 		log.Fatal(err)
@@ -67,26 +132,16 @@ func main() {
 
 	db := sqlite.StdDB
 	db.SetDir(gowarden.dir)
-	err = db.Open()
+	if gowarden.initDB || !db.Exists() {
+		sugar.Info("Try to initialize database ...")
+	}
+	err = db.Setup(gowarden.initDB)
 	if err != nil {
 		sugar.Fatal(err)
 		return
 	}
 	defer db.Close()
 
-	// just for test TODO delete
-	// gowarden.initDB = true
-
-	if gowarden.initDB || !utils.PathExist("gowarden-db") {
-		sugar.Info("Try to initialize database ...")
-		err := db.Init()
-		if err != nil {
-			logrus.Fatal(err)
-			return
-		}
-		sugar.Info("Database initialized.")
-	}
-
 	// TODO test
 	if gowarden.csvFile != "" {
 		sugar.Info("Try to import data from csv file ...")
@@ -103,7 +158,13 @@ func main() {
 	}
 
 	r := mux.NewRouter()
-	handler := api.New(db, gowarden.secretKey, sugar, gowarden.faviconProxyServer)
+	handler := api.New(db, gowarden.secretKey, sugar)
+
+	passwordHash, err := api.NewPasswordHash(gowarden.passwordHash, gowarden.passwordIterations, gowarden.passwordMemory, gowarden.passwordParallelism)
+	if err != nil {
+		sugar.Fatal(err)
+	}
+	handler.SetPasswordHash(passwordHash)
 
 	if !gowarden.disableRegistration {
 		r.HandleFunc("/api/accounts/register", handler.HandleRegister)
@@ -114,13 +175,37 @@ func main() {
 
 	// Must login can access these api.
 	r.HandleFunc("/api/accounts/keys", handler.AuthMiddleware(handler.HandleAccountKeys))
+	r.HandleFunc("/api/accounts/revision-date", handler.AuthMiddleware(handler.HandleRevisionDate)).Methods(http.MethodGet)
+	r.HandleFunc("/api/accounts/profile", handler.AuthMiddleware(handler.HandleGetProfile)).Methods(http.MethodGet)
+	r.HandleFunc("/api/accounts/profile", handler.AuthMiddleware(handler.HandleUpdateProfile)).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/api/accounts/avatar", handler.AuthMiddleware(handler.HandleUpdateAvatar)).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/api/accounts/kdf", handler.AuthMiddleware(handler.HandleChangeKdf)).Methods(http.MethodPost)
+	r.HandleFunc("/api/accounts/password", handler.AuthMiddleware(handler.HandleChangePassword)).Methods(http.MethodPost)
+	r.HandleFunc("/api/accounts/security-stamp", handler.AuthMiddleware(handler.HandleSecurityStamp)).Methods(http.MethodPost)
+	handler.SetLogEmailTokens(gowarden.logEmailTokens)
+	r.HandleFunc("/api/accounts/email-token", handler.AuthMiddleware(handler.HandleEmailToken)).Methods(http.MethodPost)
+	r.HandleFunc("/api/accounts/email", handler.AuthMiddleware(handler.HandleChangeEmail)).Methods(http.MethodPost)
+	r.HandleFunc("/api/accounts", handler.AuthMiddleware(handler.HandleDeleteAccount)).Methods(http.MethodDelete)
+	r.HandleFunc("/api/accounts/delete", handler.AuthMiddleware(handler.HandleDeleteAccount)).Methods(http.MethodPost)
 	r.HandleFunc("/api/sync", handler.AuthMiddleware(handler.HandleSync)).Methods(http.MethodGet)
 	r.HandleFunc("/notifications/hub/negotiate", handler.AuthMiddleware(handler.HandleNegotiate))
+	r.HandleFunc("/api/ciphers", handler.AuthMiddleware(handler.HandleGetCiphers)).Methods(http.MethodGet)
 	r.HandleFunc("/api/ciphers", handler.AuthMiddleware(handler.HandleCiphers)).Methods(http.MethodPost)
+	r.HandleFunc("/api/ciphers/move", handler.AuthMiddleware(handler.HandleMoveCiphers)).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/api/ciphers/import", handler.AuthMiddleware(handler.HandleImportCiphers)).Methods(http.MethodPost)
+	r.HandleFunc("/api/ciphers/purge", handler.AuthMiddleware(handler.HandlePurgeCiphers)).Methods(http.MethodPost)
+	r.HandleFunc("/api/ciphers/{cipherId}", handler.AuthMiddleware(handler.HandleGetCipher)).Methods(http.MethodGet)
+	r.HandleFunc("/api/ciphers/{cipherId}/details", handler.AuthMiddleware(handler.HandleGetCipher)).Methods(http.MethodGet)
 	r.HandleFunc("/api/ciphers/{cipherId}", handler.AuthMiddleware(handler.HandleUpdateCiphers)).Methods(http.MethodPut)
+	r.HandleFunc("/api/ciphers/{cipherId}/partial", handler.AuthMiddleware(handler.HandlePartialUpdateCipher)).Methods(http.MethodPut, http.MethodPost)
 	r.HandleFunc("/api/ciphers/{cipherId}", handler.AuthMiddleware(handler.HandleDeleteCiphers)).Methods(http.MethodDelete)
 
+	r.HandleFunc("/api/settings/domains", handler.AuthMiddleware(handler.HandleGetDomains)).Methods(http.MethodGet)
+	r.HandleFunc("/api/settings/domains", handler.AuthMiddleware(handler.HandleUpdateDomains)).Methods(http.MethodPut, http.MethodPost)
+
+	r.HandleFunc("/api/folders", handler.AuthMiddleware(handler.HandleGetFolders)).Methods(http.MethodGet)
 	r.HandleFunc("/api/folders", handler.AuthMiddleware(handler.HandleFolder)).Methods(http.MethodPost)
+	r.HandleFunc("/api/folders/{folderUUID}", handler.AuthMiddleware(handler.HandleGetFolder)).Methods(http.MethodGet)
 	r.HandleFunc("/api/folders/{folderUUID}", handler.AuthMiddleware(handler.HandleFolderRename)).Methods(http.MethodPut)
 	r.HandleFunc("/api/folders/{folderUUID}", handler.AuthMiddleware(handler.HandleFolderDelete)).Methods(http.MethodDelete)
 
@@ -133,31 +218,137 @@ func main() {
 			}
 			sugar.Info("Success to create icons folder.")
 		}
+		cache, err := favicon.NewCache("icons", gowarden.iconCacheSize, gowarden.iconCacheTTL, gowarden.iconNegativeTTL)
+		if err != nil {
+			sugar.Fatal(err)
+		}
+		handler.SetIconService(favicon.New(favicon.NewFetcher(10*time.Second), cache))
 		r.HandleFunc("/icons/{domain}/{icon}", handler.HandleFavicon).Methods(http.MethodGet)
 	}
 
-	if !utils.IsDir("attachments") {
-		sugar.Info("Didn't find attachments's folder, try to create ...")
-		err = os.Mkdir("attachments", os.ModePerm)
+	switch gowarden.storage {
+	case "fs":
+		if !utils.IsDir("attachments") {
+			sugar.Info("Didn't find attachments's folder, try to create ...")
+			err = os.Mkdir("attachments", os.ModePerm)
+			if err != nil {
+				sugar.Error(err)
+			}
+			sugar.Info("Success to create attachments folder.")
+		}
+	case "s3":
+		blobs, err := storage.NewS3(gowarden.s3)
 		if err != nil {
-			sugar.Error(err)
+			sugar.Fatal(err)
 		}
-		sugar.Info("Success to create attachments folder.")
+		handler.SetBlobStore(blobs)
+	default:
+		sugar.Fatalf("Unknown storage %v, use fs or s3.", gowarden.storage)
 	}
-	r.HandleFunc("/api/ciphers/{cipherId}/attachment", handler.AuthMiddleware(handler.HandleAddAttachment)).Methods(http.MethodPost)
+	handler.SetStorageLimits(gowarden.maxAttachmentSize, gowarden.storageQuota)
+	upload := r.HandleFunc("/api/ciphers/{cipherId}/attachment", handler.AuthMiddleware(handler.HandleAddAttachment)).Methods(http.MethodPost)
+	r.HandleFunc("/api/ciphers/{cipherId}/attachment/{attachmentId}", handler.AuthMiddleware(handler.HandleAttachmentInfo)).Methods(http.MethodGet)
 	r.HandleFunc("/api/ciphers/{cipherId}/attachment/{attachmentId}", handler.AuthMiddleware(handler.HandleDeleteAttachment)).Methods(http.MethodDelete)
 	r.HandleFunc("/attachments/{cipherId}/{attachmentId}", handler.HandleGetAttachment).Methods(http.MethodGet)
 
+	if gowarden.adminToken != "" {
+		handler.SetAdminToken(gowarden.adminToken)
+		r.HandleFunc("/admin/usage", handler.AdminMiddleware(handler.HandleStorageUsage)).Methods(http.MethodGet)
+	}
+
 	// for cors
 	headersOK := handlers.AllowedHeaders([]string{"Accept", "Accept-Language", "Content-Language", "Content-Type"})
 	originsOK := handlers.AllowedOrigins([]string{"*"})
 	methodsOK := handlers.AllowedMethods([]string{"GET", "POST", "HEAD", "PUT", "OPTIONS", "DELETE"})
 
-	if gowarden.enableHttps {
-		log.Fatal(http.ListenAndServeTLS("127.0.0.1"+gowarden.port, gowarden.cert, gowarden.key, handlers.CORS(headersOK, originsOK, methodsOK)(r)))
-	} else {
-		log.Fatal(http.ListenAndServe("127.0.0.1:"+gowarden.port, handlers.CORS(headersOK, originsOK, methodsOK)(r)))
+	var root http.Handler = r
+	prefix := ""
+	if gowarden.domain != "" {
+		domain, err := parseDomain(gowarden.domain)
+		if err != nil {
+			sugar.Fatal(err)
+		}
+		handler.SetDomain(domain.String())
+		// Serve under the path of the domain, like /vault/api/sync.
+		if domain.Path != "" {
+			prefix = domain.Path
+			root = http.StripPrefix(prefix, r)
+		}
+	}
+
+	cfg := gowarden.server
+	cfg.Addr = net.JoinHostPort(gowarden.bind, gowarden.port)
+	cfg.TrustedProxies, err = server.ParseCIDRs(gowarden.trustedProxies)
+	if err != nil {
+		sugar.Fatal(err)
+	}
+	cfg.MaxHeaderBytes = server.DefaultConfig.MaxHeaderBytes
+	// Only attachment uploads may be bigger than -maxBodySize.
+	cfg.IsUpload = func(req *http.Request) bool {
+		if !strings.HasPrefix(req.URL.Path, prefix) {
+			return false
+		}
+		u := *req.URL
+		u.Path = strings.TrimPrefix(u.Path, prefix)
+		u.RawPath = ""
+		return upload.Match(&http.Request{Method: req.Method, URL: &u, Host: req.Host, Header: req.Header}, &mux.RouteMatch{})
+	}
+	if gowarden.acmeDomains != "" {
+		cfg.ACMEDomains = strings.Split(gowarden.acmeDomains, ",")
+	} else if gowarden.enableHttps {
+		if gowarden.cert == "" || gowarden.key == "" {
+			sugar.Fatal("-enableHttps needs -certFile and -keyFile, or -acmeDomains.")
+		}
+		cfg.CertFile, cfg.KeyFile = gowarden.cert, gowarden.key
+	}
+
+	err = server.New(cfg, handlers.CORS(headersOK, originsOK, methodsOK)(root), sugar).Run()
+	if err != nil {
+		sugar.Fatal(err)
+	}
+}
+
+// parseDomain checks the -domain url, the result has no trailing slash.
+func parseDomain(s string) (*url.URL, error) {
+	domain, err := url.Parse(s)
+	if err != nil || (domain.Scheme != "http" && domain.Scheme != "https") || domain.Host == "" ||
+		domain.RawQuery != "" || domain.Fragment != "" {
+		return nil, fmt.Errorf("-domain must be an url like https://example.com/vault, not %v", s)
 	}
+
+	domain.Path = strings.TrimSuffix(domain.Path, "/")
+	domain.RawPath = ""
+	return domain, nil
+}
+
+// iconsCommand handles "gowarden icons purge [domain]", removing cached icons.
+func iconsCommand(args []string) error {
+	if len(args) < 1 || args[0] != "purge" || len(args) > 2 {
+		return errors.New("usage: gowarden icons purge [domain]")
+	}
+
+	if !utils.IsDir("icons") {
+		fmt.Println("No icon cache found.")
+		return nil
+	}
+
+	cache, err := favicon.NewCache("icons", 0, gowarden.iconCacheTTL, gowarden.iconNegativeTTL)
+	if err != nil {
+		return err
+	}
+
+	domain := ""
+	if len(args) == 2 {
+		domain = strings.ToLower(args[1])
+	}
+
+	n, err := cache.Purge(domain)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Purged %v cached icons.\n", n)
+	return nil
 }
 
 func importFromCSV(file string) ([]ds.CSV, error) {
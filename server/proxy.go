@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDRs parses a comma separated list of networks like
+// "10.0.0.0/8,::1", single addresses are networks of their own.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.New("invalid address " + cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// proxyHeaders takes the client address, scheme and host of requests from
+// trusted proxies from their X-Forwarded-For or X-Real-IP, X-Forwarded-Proto
+// and X-Forwarded-Host headers. Anybody else could make them up, so they are
+// removed from other requests. trustAll is for requests over a unix socket,
+// which only the proxy can reach.
+func proxyHeaders(h http.Handler, trusted []*net.IPNet, trustAll bool) http.Handler {
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+
+		if !trustAll && !isTrusted(remote) {
+			for _, name := range []string{"X-Forwarded-For", "X-Real-Ip", "X-Forwarded-Proto", "X-Forwarded-Host"} {
+				r.Header.Del(name)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Every proxy appends the address it got the request from, the
+		// client is the last one not added by one of ours.
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addrs := strings.Split(forwarded, ",")
+			client := ""
+			for i := len(addrs) - 1; i >= 0; i-- {
+				client = strings.TrimSpace(addrs[i])
+				if !isTrusted(client) {
+					break
+				}
+			}
+			if net.ParseIP(client) != nil {
+				r.RemoteAddr = client
+			}
+		} else if ip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); net.ParseIP(ip) != nil {
+			r.RemoteAddr = ip
+		}
+
+		// Proxies in front of ours add their schemes behind the client's.
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+
+		if host := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0]); host != "" {
+			r.Host = host
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
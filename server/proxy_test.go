@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs(" 127.0.0.1, 10.0.0.0/8,::1 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 || nets[0].String() != "127.0.0.1/32" || nets[1].String() != "10.0.0.0/8" || nets[2].String() != "::1/128" {
+		t.Errorf("Parsed %v", nets)
+	}
+
+	for _, s := range []string{"localhost", "10.0.0.0/33"} {
+		if _, err = ParseCIDRs(s); err == nil {
+			t.Errorf("Parsed invalid %v", s)
+		}
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	trusted, err := ParseCIDRs("127.0.0.1,10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		socket  bool
+
+		wantRemote, wantScheme, wantHost string
+	}{
+		{"direct", "192.0.2.1:1234", nil, false, "192.0.2.1:1234", "", "example.com"},
+		{"untrusted", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.com"}, false,
+			"192.0.2.1:1234", "", "example.com"},
+		{"trusted", "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "vault.example.com"}, false,
+			"198.51.100.1", "https", "vault.example.com"},
+		{"chain", "127.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.1, 10.0.0.2", "X-Forwarded-Proto": "https, http"}, false,
+			"198.51.100.1", "https", "example.com"},
+		{"real ip", "127.0.0.1:1234", map[string]string{"X-Real-Ip": "198.51.100.1", "X-Forwarded-Proto": "gopher"}, false,
+			"198.51.100.1", "", "example.com"},
+		{"unix socket", "@", map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Forwarded-Proto": "https"}, true,
+			"198.51.100.1", "https", "example.com"},
+	} {
+		var got *http.Request
+		h := proxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r
+		}), trusted, c.socket)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/sync", nil)
+		req.RemoteAddr = c.remote
+		for name, value := range c.headers {
+			req.Header.Set(name, value)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got.RemoteAddr != c.wantRemote || got.URL.Scheme != c.wantScheme || got.Host != c.wantHost {
+			t.Errorf("%v: got %v %q %v, want %v %q %v", c.name, got.RemoteAddr, got.URL.Scheme, got.Host, c.wantRemote, c.wantScheme, c.wantHost)
+		}
+		if c.name == "untrusted" && got.Header.Get("X-Forwarded-For") != "" {
+			t.Errorf("%v: X-Forwarded-For of an untrusted client is kept", c.name)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Config of the http server, zero durations and sizes mean no limit.
+type Config struct {
+	// Address to listen on like 127.0.0.1:9527, ignored if Socket is set.
+	Addr string
+	// Path of a unix socket to listen on instead, for reverse proxies on the same host.
+	Socket string
+	// Reverse proxies whose X-Forwarded-* and X-Real-IP headers are
+	// believed, requests over Socket are always from a proxy.
+	TrustedProxies []*net.IPNet
+
+	// Serve https with these files if both are set. They are reloaded on
+	// SIGHUP and when they change.
+	CertFile string
+	KeyFile  string
+	// How often to check CertFile and KeyFile for changes.
+	CertCheckInterval time.Duration
+
+	// Get certificates for these domains from an ACME CA like Let's Encrypt
+	// instead of CertFile and KeyFile.
+	ACMEDomains []string
+	// Where ACME certificates and the account key are kept between restarts.
+	ACMECacheDir string
+	ACMEEmail    string
+	// Directory url of the CA, "" for Let's Encrypt. A local Pebble serves it
+	// at https://localhost:14000/dir.
+	ACMEDirectoryURL string
+	// PEM file of CAs to trust when talking to the CA, like Pebble's own.
+	ACMECARoots string
+
+	// Address of a plain http server redirecting to https, it answers ACME
+	// http-01 challenges too.
+	RedirectAddr string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// How long to wait for running requests after a SIGTERM or SIGINT.
+	ShutdownTimeout time.Duration
+
+	MaxHeaderBytes int
+	// Max size of a request body. Requests IsUpload matches are limited by
+	// MaxUploadSize instead, their handlers check their own limits too.
+	MaxBodySize   int64
+	MaxUploadSize int64
+	// IsUpload reports whether a request goes to an upload route like the
+	// attachment upload, nil means there are none.
+	IsUpload func(r *http.Request) bool
+}
+
+// DefaultConfig leaves enough time to up and download big attachments.
+var DefaultConfig = Config{
+	Addr:              "127.0.0.1:9527",
+	ReadHeaderTimeout: 10 * time.Second,
+	ReadTimeout:       5 * time.Minute,
+	WriteTimeout:      5 * time.Minute,
+	IdleTimeout:       2 * time.Minute,
+	ShutdownTimeout:   30 * time.Second,
+	CertCheckInterval: time.Minute,
+	MaxHeaderBytes:    1 << 20,
+	MaxBodySize:       32 << 20,
+}
+
+type Server struct {
+	cfg      Config
+	srv      *http.Server
+	redirect *http.Server // nil unless RedirectAddr is set.
+	certs    *certReloader
+	logger   *zap.SugaredLogger
+}
+
+func New(cfg Config, h http.Handler, logger *zap.SugaredLogger) *Server {
+	return &Server{
+		cfg: cfg,
+		srv: &http.Server{
+			Handler:           limitBody(proxyHeaders(h, cfg.TrustedProxies, cfg.Socket != ""), cfg.MaxBodySize, cfg.MaxUploadSize, cfg.IsUpload),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+			ReadTimeout:       cfg.ReadTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		},
+		logger: logger,
+	}
+}
+
+// Run serves until the process gets a SIGTERM or SIGINT, then stops taking
+// new connections and waits for running requests to finish. A SIGHUP
+// reloads the certificate files.
+func (s *Server) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	return s.run(signals)
+}
+
+func (s *Server) run(signals <-chan os.Signal) error {
+	err := s.setupTLS()
+	if err != nil {
+		return err
+	}
+
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	servers := []*http.Server{s.srv}
+	errc := make(chan error, 2)
+	go func() {
+		errc <- s.serve(l)
+	}()
+
+	if s.redirect != nil {
+		servers = append(servers, s.redirect)
+		s.logger.Infof("Redirecting http on %v to https.", s.redirect.Addr)
+		go func() {
+			errc <- s.redirect.ListenAndServe()
+		}()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if s.certs != nil && s.cfg.CertCheckInterval > 0 {
+		go s.watchCerts(done)
+	}
+
+wait:
+	for {
+		select {
+		case err = <-errc:
+			for _, srv := range servers {
+				srv.Close()
+			}
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				s.reloadCerts("SIGHUP")
+				continue
+			}
+			s.logger.Infof("Got %v, waiting for running requests ...", sig)
+			break wait
+		}
+	}
+
+	ctx := context.Background()
+	if s.cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.ShutdownTimeout)
+		defer cancel()
+	}
+
+	for _, srv := range servers {
+		if err = srv.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	for range servers {
+		if err = <-errc; err != http.ErrServerClosed {
+			return err
+		}
+	}
+
+	s.logger.Info("Server stopped.")
+	return nil
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	if s.cfg.Socket == "" {
+		s.logger.Infof("Listening on %v.", s.cfg.Addr)
+		return net.Listen("tcp", s.cfg.Addr)
+	}
+
+	// A socket left by a gowarden that didn't stop cleanly.
+	if fi, err := os.Lstat(s.cfg.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(s.cfg.Socket); err != nil {
+			return nil, err
+		}
+	}
+
+	s.logger.Infof("Listening on unix socket %v.", s.cfg.Socket)
+	return net.Listen("unix", s.cfg.Socket)
+}
+
+func (s *Server) serve(l net.Listener) error {
+	if s.srv.TLSConfig != nil {
+		return s.srv.ServeTLS(l, "", "")
+	}
+	return s.srv.Serve(l)
+}
+
+// limitBody caps the request bodies h reads, bodies said to be bigger are
+// refused before reading them. Only the routes isUpload matches get maxUpload,
+// the Content-Type is up to the client and no reason to lift the limit.
+func limitBody(h http.Handler, maxBody, maxUpload int64, isUpload func(*http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		max := maxBody
+		if isUpload != nil && isUpload(r) {
+			max = maxUpload
+		}
+
+		if max > 0 {
+			if r.ContentLength > max {
+				w.Header().Set("Connection", "close")
+				http.Error(w, "Request body too large.", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := make(chan struct{})
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+		}
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("done"))
+	})
+
+	cfg := DefaultConfig
+	cfg.Socket = filepath.Join(dir, "gowarden.sock")
+	cfg.MaxBodySize = 10
+	s := New(cfg, h, zap.NewNop().Sugar())
+
+	// A socket left from before is replaced.
+	if l, err := net.Listen("unix", cfg.Socket); err != nil {
+		t.Fatal(err)
+	} else {
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		l.Close()
+	}
+
+	stop := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.run(stop)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			for i := 0; ; i++ {
+				conn, err := d.DialContext(ctx, "unix", cfg.Socket)
+				if err == nil || i == 50 {
+					return conn, err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	}}
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{"small", http.StatusOK},
+		{"far too large", http.StatusRequestEntityTooLarge},
+	} {
+		res, err := client.Post("http://gowarden/", "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != c.code {
+			t.Errorf("Body %q: response code is %v, want %v", c.body, res.StatusCode, c.code)
+		}
+	}
+
+	slow := make(chan error, 1)
+	go func() {
+		res, err := client.Get("http://gowarden/slow")
+		if err == nil {
+			var b []byte
+			b, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err == nil && string(b) != "done" {
+				err = fmt.Errorf("unexpected body %q", b)
+			}
+		}
+		slow <- err
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+
+	if err = <-slow; err != nil {
+		t.Errorf("Running request failed during shutdown: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+
+	if _, err = os.Stat(cfg.Socket); !os.IsNotExist(err) {
+		t.Errorf("Socket is left after shutdown: %v", err)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	h := limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}), 10, 100, func(r *http.Request) bool {
+		return r.URL.Path == "/api/ciphers/1/attachment"
+	})
+
+	for _, c := range []struct {
+		path, contentType string
+		size              int
+		chunked           bool
+		want              int
+	}{
+		{"/api/ciphers", "application/json", 10, false, http.StatusOK},
+		{"/api/ciphers", "application/json", 11, false, http.StatusRequestEntityTooLarge},
+		// The Content-Type doesn't make a JSON route an upload.
+		{"/api/ciphers", "multipart/form-data; boundary=x", 50, false, http.StatusRequestEntityTooLarge},
+		{"/api/ciphers", "multipart/form-data; boundary=x", 50, true, http.StatusRequestEntityTooLarge},
+		{"/api/ciphers/1/attachment", "multipart/form-data; boundary=x", 50, false, http.StatusOK},
+		{"/api/ciphers/1/attachment", "multipart/form-data; boundary=x", 101, true, http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(strings.Repeat("a", c.size)))
+		r.Header.Set("Content-Type", c.contentType)
+		if c.chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%v %v bytes as %v: got %v, want %v", c.path, c.size, c.contentType, w.Code, c.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// setupTLS configures https from either ACME or the cert and key file, and
+// the server redirecting http to https.
+func (s *Server) setupTLS() error {
+	var challenges func(http.Handler) http.Handler
+
+	switch {
+	case len(s.cfg.ACMEDomains) > 0:
+		if s.cfg.CertFile != "" || s.cfg.KeyFile != "" {
+			return errors.New("use either ACME or a cert and key file")
+		}
+		m, err := newACMEManager(s.cfg)
+		if err != nil {
+			return err
+		}
+		s.srv.TLSConfig = m.TLSConfig()
+		challenges = m.HTTPHandler
+	case s.cfg.CertFile != "" && s.cfg.KeyFile != "":
+		certs, err := newCertReloader(s.cfg.CertFile, s.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		s.certs = certs
+		s.srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	case s.cfg.CertFile != "" || s.cfg.KeyFile != "":
+		return errors.New("https needs both a cert and a key file")
+	default:
+		if s.cfg.RedirectAddr != "" {
+			return errors.New("redirecting to https needs https")
+		}
+		return nil
+	}
+
+	if s.cfg.RedirectAddr != "" {
+		port := ""
+		if s.cfg.Socket == "" {
+			_, port, _ = net.SplitHostPort(s.cfg.Addr)
+		}
+
+		h := redirectHandler(port)
+		if challenges != nil {
+			h = challenges(h)
+		}
+		s.redirect = &http.Server{
+			Addr:              s.cfg.RedirectAddr,
+			Handler:           h,
+			ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+			IdleTimeout:       s.cfg.IdleTimeout,
+			MaxHeaderBytes:    s.cfg.MaxHeaderBytes,
+		}
+	}
+
+	return nil
+}
+
+// newACMEManager gets certificates for the configured domains and renews
+// them before they expire.
+func newACMEManager(cfg Config) (*autocert.Manager, error) {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMECacheDir != "" {
+		m.Cache = autocert.DirCache(cfg.ACMECacheDir)
+	}
+
+	if cfg.ACMEDirectoryURL == "" && cfg.ACMECARoots == "" {
+		return m, nil
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectoryURL}
+	if cfg.ACMECARoots != "" {
+		pem, err := ioutil.ReadFile(cfg.ACMECARoots)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + cfg.ACMECARoots)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+	m.Client = client
+
+	return m, nil
+}
+
+// redirectHandler sends clients to the same url on https, on port unless
+// it's empty or 443.
+func redirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		// 308 keeps the method and body of requests other than GET.
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
+
+// certReloader serves the certificate of a cert and key file, reloading it
+// when the files change so renewed certificates don't need a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+// reload loads the files again, the old certificate stays on errors.
+func (c *certReloader) reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert, c.modTime = &cert, modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// changed reports whether the files changed since they were loaded.
+func (c *certReloader) changed() bool {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		// Likely in the middle of being replaced, try next time.
+		return false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !modTime.Equal(c.modTime)
+}
+
+// filesModTime returns the later modification time of the two files.
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// reloadCerts reloads the certificate files, why is logged along.
+func (s *Server) reloadCerts(why string) {
+	if s.certs == nil {
+		return
+	}
+
+	if err := s.certs.reload(); err != nil {
+		s.logger.Errorf("Failed to reload the certificate after %v: %v", why, err)
+		return
+	}
+	s.logger.Infof("Reloaded the certificate after %v.", why)
+}
+
+// watchCerts reloads the certificate files whenever they change, until done is closed.
+func (s *Server) watchCerts(done <-chan struct{}) {
+	ticker := time.NewTicker(s.cfg.CertCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if s.certs.changed() {
+				s.reloadCerts("the files changed")
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self signed certificate with serial and its key.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, 1)
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial := func() int64 {
+		cert, _ := c.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	if c.changed() {
+		t.Error("Files changed right after loading them")
+	}
+
+	// Renewed certificate, dated later than the first in case both were
+	// written within the resolution of the file system.
+	writeCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, keyFile} {
+		if err = os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !c.changed() {
+		t.Fatal("Renewed files didn't change")
+	}
+	if err = c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("Serving certificate %v after reload, want 2", got)
+	}
+
+	if err = ioutil.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.reload(); err == nil {
+		t.Error("Reloading a broken certificate succeeded")
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("Serving certificate %v after a failed reload, want 2", got)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	for _, c := range []struct {
+		port, method, url string
+		code              int
+		location          string
+	}{
+		{"443", http.MethodGet, "http://example.com/api/sync?excludeDomains=true", http.StatusMovedPermanently, "https://example.com/api/sync?excludeDomains=true"},
+		{"8443", http.MethodGet, "http://example.com:8080/", http.StatusMovedPermanently, "https://example.com:8443/"},
+		{"", http.MethodPost, "http://example.com:80/identity/connect/token", http.StatusPermanentRedirect, "https://example.com/identity/connect/token"},
+	} {
+		w := httptest.NewRecorder()
+		redirectHandler(c.port).ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+
+		if w.Code != c.code || w.Header().Get("Location") != c.location {
+			t.Errorf("%v %v: got %v %v, want %v %v", c.method, c.url, w.Code, w.Header().Get("Location"), c.code, c.location)
+		}
+	}
+}
+
+// TestACMEPebble gets a certificate from a Pebble test CA. It only runs with
+// GOWARDEN_PEBBLE_DIR set to Pebble's directory url like
+// https://localhost:14000/dir and GOWARDEN_PEBBLE_CA to its
+// test/certs/pebble.minica.pem. Start Pebble with PEBBLE_VA_ALWAYS_VALID=1,
+// it can't reach this test to validate challenges. Use Pebble v2.5 or older,
+// newer ones finalize orders in the background without the Location header
+// the acme package needs to wait for them.
+func TestACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("GOWARDEN_PEBBLE_DIR")
+	if directoryURL == "" {
+		t.Skip("GOWARDEN_PEBBLE_DIR is not set")
+	}
+
+	dir, err := ioutil.TempDir("", "gowarden-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const domain = "gowarden.test"
+	m, err := newACMEManager(Config{
+		ACMEDomains:      []string{domain},
+		ACMECacheDir:     dir,
+		ACMEDirectoryURL: directoryURL,
+		ACMECARoots:      os.Getenv("GOWARDEN_PEBBLE_CA"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err = m.Client.Discover(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = leaf.VerifyHostname(domain); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); err == nil {
+		t.Error("Got a certificate for a domain that isn't configured")
+	}
+}
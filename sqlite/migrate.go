@@ -0,0 +1,319 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/404cn/gowarden/ds"
+)
+
+// migrations upgrade databases created by older versions of gowarden. The
+// schema version, stored in sqlite's user_version, counts the migrations
+// already applied. Only ever append to this list, and keep the CREATE TABLE
+// statements in sync so Init creates the latest schema right away.
+var migrations = []func(tx *sql.Tx) error{
+	// Equivalent domains settings.
+	execAll(
+		`ALTER TABLE accounts ADD COLUMN equivalentDomains TEXT NOT NULL DEFAULT '[]'`,
+		`ALTER TABLE accounts ADD COLUMN excludedGlobalEquivalentDomains TEXT NOT NULL DEFAULT '[]'`,
+	),
+	// Account revision date for conditional sync, starting now so clients sync once.
+	execAll(
+		`ALTER TABLE accounts ADD COLUMN revisionDate INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE accounts SET revisionDate = CAST(strftime('%s', 'now') AS INTEGER) * 1000`,
+	),
+	// Indexes for loading whole vaults at once.
+	execAll(
+		`CREATE INDEX IF NOT EXISTS ciphers_accountId ON ciphers(accountId)`,
+		`CREATE INDEX IF NOT EXISTS folders_accountId ON folders(accountId)`,
+		`CREATE INDEX IF NOT EXISTS logins_cipherId ON logins(cipherId)`,
+		`CREATE INDEX IF NOT EXISTS uris_cipherId ON uris(cipherId)`,
+		`CREATE INDEX IF NOT EXISTS fields_cipherId ON fields(cipherId)`,
+		`CREATE INDEX IF NOT EXISTS attachments_cipherId ON attachments(cipherId)`,
+		`CREATE INDEX IF NOT EXISTS cards_cipherId ON cards(cipherId)`,
+		`CREATE INDEX IF NOT EXISTS identities_cipherId ON identities(cipherId)`,
+	),
+	// Cipher content as json documents instead of a table per item type.
+	cipherDocuments,
+	// Argon2id accounts, existing accounts use PBKDF2.
+	execAll(
+		`ALTER TABLE accounts ADD COLUMN kdf INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE accounts ADD COLUMN kdfMemory INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE accounts ADD COLUMN kdfParallelism INTEGER NOT NULL DEFAULT 0`,
+	),
+	// Verifying the new address of an email change.
+	execAll(
+		`ALTER TABLE accounts ADD COLUMN pendingEmail TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE accounts ADD COLUMN emailToken TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE accounts ADD COLUMN emailTokenExpires INTEGER NOT NULL DEFAULT 0`,
+	),
+	// Profile settings.
+	execAll(
+		`ALTER TABLE accounts ADD COLUMN culture TEXT NOT NULL DEFAULT 'en-US'`,
+		`ALTER TABLE accounts ADD COLUMN avatarColor TEXT NOT NULL DEFAULT ''`,
+	),
+	// Security stamps access tokens are checked against, every existing
+	// account gets a random one.
+	execAll(
+		`ALTER TABLE accounts ADD COLUMN securityStamp TEXT NOT NULL DEFAULT ''`,
+		`UPDATE accounts SET securityStamp = lower(hex(randomblob(16)))`,
+	),
+	// Global domain types numbered like bitwarden's.
+	renumberGlobalDomains,
+	// Limiting the guesses of an email token.
+	execAll(
+		`ALTER TABLE accounts ADD COLUMN emailTokenAttempts INTEGER NOT NULL DEFAULT 0`,
+	),
+}
+
+func execAll(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("Sql error with %s\n%s", stmt, err.Error())
+			}
+		}
+		return nil
+	}
+}
+
+func (db *DB) schemaVersion() (int, error) {
+	var version int
+	err := db.db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+func (db *DB) setSchemaVersion(version int) error {
+	// PRAGMA doesn't take parameters.
+	_, err := db.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	return err
+}
+
+// Migrate brings an existing database up to the latest schema, each
+// migration runs in its own transaction.
+func (db *DB) Migrate() error {
+	version, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if err = migrations[version](tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// Keep the version bump in the same transaction as the migration.
+		if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renumberGlobalDomains moves the excluded global domain types of accounts to
+// bitwarden's numbering. Google and Apple were 5 and 6 instead of 0 and 1,
+// which pushed every type from 5 on up by two.
+func renumberGlobalDomains(tx *sql.Tx) error {
+	excluded := make(map[string][]int)
+
+	rows, err := tx.Query("SELECT id, excludedGlobalEquivalentDomains FROM accounts")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id, types string
+		if err = rows.Scan(&id, &types); err != nil {
+			rows.Close()
+			return err
+		}
+		var old []int
+		if err = json.Unmarshal([]byte(types), &old); err != nil {
+			rows.Close()
+			return err
+		}
+		excluded[id] = old
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, old := range excluded {
+		renumbered := make([]int, 0, len(old))
+		for _, t := range old {
+			switch {
+			case t == 5 || t == 6:
+				renumbered = append(renumbered, t-5)
+			case t >= 2 && t <= 4:
+				renumbered = append(renumbered, t)
+			case t >= 7 && t <= 92 && t != 69:
+				renumbered = append(renumbered, t-2)
+			}
+		}
+
+		types, err := json.Marshal(renumbered)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE accounts SET excludedGlobalEquivalentDomains=$1 WHERE id=$2", string(types), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cipherDocuments moves the content of ciphers from the logins, uris, fields,
+// cards and identities tables into the data column of ciphers.
+func cipherDocuments(tx *sql.Tx) error {
+	var ciphers []ds.Cipher
+
+	rows, err := tx.Query("SELECT id, type, name, notes FROM ciphers")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var cipher ds.Cipher
+		if err = rows.Scan(&cipher.Id, &cipher.Type, &cipher.Name, &cipher.Notes); err != nil {
+			rows.Close()
+			return err
+		}
+		ciphers = append(ciphers, cipher)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range ciphers {
+		if err = loadLegacyCipher(tx, &ciphers[i]); err != nil {
+			return err
+		}
+	}
+
+	err = execAll(
+		`CREATE TABLE "ciphers_new" (
+                        id TEXT,
+                        accountId TEXT,
+                        revisionDate INTEGER,
+                        type INTEGER,
+                        folderId TEXT,
+                        favorite INTEGER NOT NULL,
+                        dataVersion INTEGER NOT NULL,
+                        data TEXT NOT NULL,
+                        PRIMARY KEY(id)
+                    )`,
+		`INSERT INTO ciphers_new SELECT id, accountId, revisionDate, type, folderId, favorite, 0, '{}' FROM ciphers`,
+	)(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, cipher := range ciphers {
+		data, err := marshalCipher(cipher)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE ciphers_new SET dataVersion=$1, data=$2 WHERE id=$3", cipherDataVersion, data, cipher.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return execAll(
+		`DROP TABLE ciphers`,
+		`ALTER TABLE ciphers_new RENAME TO ciphers`,
+		`CREATE INDEX IF NOT EXISTS ciphers_accountId ON ciphers(accountId)`,
+		`DROP TABLE IF EXISTS logins`,
+		`DROP TABLE IF EXISTS uris`,
+		`DROP TABLE IF EXISTS fields`,
+		`DROP TABLE IF EXISTS cards`,
+		`DROP TABLE IF EXISTS identities`,
+	)(tx)
+}
+
+// loadLegacyCipher reads the content of cipher from the tables used before
+// cipherDocuments.
+func loadLegacyCipher(tx *sql.Tx, cipher *ds.Cipher) error {
+	err := tx.QueryRow("SELECT username, password, totp FROM logins WHERE cipherId=$1", cipher.Id).Scan(&cipher.Login.Username, &cipher.Login.Password, &cipher.Login.Totp)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	uriRows, err := tx.Query("SELECT match, uri FROM uris WHERE cipherId=$1", cipher.Id)
+	if err != nil {
+		return err
+	}
+	defer uriRows.Close()
+	for uriRows.Next() {
+		var uri ds.Uri
+		if err = uriRows.Scan(&uri.Match, &uri.Uri); err != nil {
+			return err
+		}
+		cipher.Login.Uris = append(cipher.Login.Uris, uri)
+	}
+	if err = uriRows.Err(); err != nil {
+		return err
+	}
+
+	fieldRows, err := tx.Query("SELECT type, name, value FROM fields WHERE cipherId=$1", cipher.Id)
+	if err != nil {
+		return err
+	}
+	defer fieldRows.Close()
+	for fieldRows.Next() {
+		var field ds.Field
+		if err = fieldRows.Scan(&field.Type, &field.Name, &field.Value); err != nil {
+			return err
+		}
+		cipher.Fields = append(cipher.Fields, field)
+	}
+	if err = fieldRows.Err(); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow("SELECT cardholdername, brand, number, expmonth, expyear, code FROM cards WHERE cipherId=$1", cipher.Id).Scan(&cipher.Card.CardholderName, &cipher.Card.Brand, &cipher.Card.Number, &cipher.Card.ExpMonth, &cipher.Card.ExpYear, &cipher.Card.Code)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	err = tx.QueryRow("SELECT title, firstname, middlename, lastname, address1, address2, address3, city, state, postalcode, country, company, email, phone, ssn, username, passportnumber, licensenumber FROM identities WHERE cipherId=$1", cipher.Id).Scan(
+		&cipher.Identity.Title,
+		&cipher.Identity.FirstName,
+		&cipher.Identity.MiddleName,
+		&cipher.Identity.LastName,
+		&cipher.Identity.Address1,
+		&cipher.Identity.Address2,
+		&cipher.Identity.Address3,
+		&cipher.Identity.City,
+		&cipher.Identity.State,
+		&cipher.Identity.PostalCode,
+		&cipher.Identity.Country,
+		&cipher.Identity.Company,
+		&cipher.Identity.Email,
+		&cipher.Identity.Phone,
+		&cipher.Identity.SSN,
+		&cipher.Identity.Username,
+		&cipher.Identity.PassportNumber,
+		&cipher.Identity.LicenseNumber)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	return nil
+}
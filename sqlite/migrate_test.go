@@ -0,0 +1,138 @@
+package sqlite
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/404cn/gowarden/ds"
+)
+
+// Schema of databases created before migrations existed.
+var legacySchema = []string{
+	`CREATE TABLE "accounts" (id TEXT, name TEXT, email TEXT UNIQUE, masterPasswordHash TEXT, masterPasswordHint TEXT, key INTEGER, kdfIterations INTEGER, publicKey TEXT NOT NULL, encryptedPrivateKey TEXT NOT NULL, refreshToken TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "folders" (id TEXT, name TEXT, revisionDate INTEGER, accountId TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "ciphers" (id TEXT, accountId TEXT, revisionDate INTEGER, type INTEGER, folderId TEXT, favorite INTEGER NOT NULL, name TEXT, notes TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "logins" (id TEXT, cipherId TEXT, username TEXT, password TEXT, totp TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "uris" (id TEXT, cipherId TEXT, match INTEGER, uri TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "fields" (id TEXT, cipherId TEXT, type INTEGER, name TEXT, value TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "attachments" (id TEXT, cipherId TEXT, filename TEXT, key Text, size Text, url TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "cards" (id TEXT, cipherId TEXT, cardholdername TEXT, brand TEXT, number TEXT, expmonth TEXT, expyear TEXT, code TEXT, PRIMARY KEY(id))`,
+	`CREATE TABLE "identities" (id TEXT, cipherId TEXT, title TEXT, firstname TEXT, middlename TEXT, lastname TEXT, address1 TEXT, address2 TEXT, address3 TEXT, city TEXT, state TEXT, postalcode TEXT, country TEXT, company TEXT, email TEXT, phone TEXT, ssn TEXT, username TEXT, passportnumber TEXT, licensenumber TEXT, PRIMARY KEY(id))`,
+
+	`INSERT INTO accounts VALUES('acc', '', 'nobody@example.com', 'hash', '', '', 100000, '', '', '')`,
+	`INSERT INTO ciphers VALUES('login', 'acc', 1590000000, 1, '', 1, '2.login', '2.notes')`,
+	`INSERT INTO logins VALUES('l1', 'login', '2.username', '2.password', '')`,
+	`INSERT INTO uris VALUES('u1', 'login', 0, '2.uri1')`,
+	`INSERT INTO uris VALUES('u2', 'login', 3, '2.uri2')`,
+	`INSERT INTO fields VALUES('f1', 'login', 1, '2.name', '2.value')`,
+	`INSERT INTO attachments VALUES('a1', 'login', '2.file', '2.key', '2048', '')`,
+	`INSERT INTO ciphers VALUES('identity', 'acc', 1590000000, 4, '', 0, '2.identity', '')`,
+	`INSERT INTO identities VALUES('i1', 'identity', '', '2.first', '', '2.last', '', '', '', '', '', '', '', '', '2.email', '', '', '', '', '')`,
+}
+
+func TestMigrate(t *testing.T) {
+	db := newTestDB(t)
+
+	// Start over with a database from before migrations.
+	for _, table := range []string{"accounts", "folders", "ciphers", "attachments"} {
+		if _, err := db.db.Exec("DROP TABLE " + table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.setSchemaVersion(0); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = execAll(legacySchema...)(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := db.schemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Schema version is %d, want %d", version, len(migrations))
+	}
+
+	ciphers, err := db.GetCiphers("acc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphers) != 2 {
+		t.Fatalf("Got %d ciphers, want 2", len(ciphers))
+	}
+
+	for _, cipher := range ciphers {
+		switch cipher.Id {
+		case "login":
+			if cipher.Name != "2.login" || !cipher.Favorite || cipher.Login.Username != "2.username" || len(cipher.Login.Uris) != 2 || cipher.Login.Uris[1].Match != 3 {
+				t.Errorf("Login cipher migrated wrong: %+v", cipher)
+			}
+			if len(cipher.Fields) != 1 || len(cipher.Attachments) != 1 {
+				t.Errorf("Login cipher lost fields or attachments: %+v", cipher)
+			}
+		case "identity":
+			if cipher.Identity.FirstName != "2.first" || cipher.Identity.Email != "2.email" {
+				t.Errorf("Identity cipher migrated wrong: %+v", cipher.Identity)
+			}
+		default:
+			t.Errorf("Unexpected cipher %v", cipher.Id)
+		}
+	}
+
+	var tables int
+	err = db.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name IN ('logins', 'uris', 'fields', 'cards', 'identities')").Scan(&tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tables != 0 {
+		t.Errorf("%d legacy tables left", tables)
+	}
+	acc, err := db.GetAccount("nobody@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Kdf != ds.KdfPBKDF2 || acc.KdfIterations != 100000 {
+		t.Errorf("Account has kdf %v with %v iterations, want PBKDF2 with 100000", acc.Kdf, acc.KdfIterations)
+	}
+}
+
+func TestRenumberGlobalDomains(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+
+	if _, err := db.db.Exec("UPDATE accounts SET excludedGlobalEquivalentDomains='[3,5,6,7,69,92]' WHERE id=$1", acc.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = renumberGlobalDomains(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err = db.GetAccount(acc.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(acc.ExcludedGlobalEquivalentDomains); got != "[3 0 1 5 90]" {
+		t.Errorf("Excluded types are %v, want [3 0 1 5 90]", got)
+	}
+}
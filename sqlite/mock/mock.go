@@ -1,20 +1,25 @@
 package mock
 
 import (
+	"time"
+
 	"github.com/404cn/gowarden/ds"
 )
 
 type Mock struct{}
 
+// RevisionDate of everything the mock returns.
+var RevisionDate = time.Unix(1590000000, 0)
+
 func New() *Mock {
 	return &Mock{}
 }
 
-func (mock *Mock) DeleteAttachment(s1, s2 string) (string, error) {
+func (mock *Mock) DeleteAttachment(s1, s2, s3 string) (string, error) {
 	return "", nil
 }
 
-func (mock *Mock) AddAttachment(s string, att ds.Attachment) (ds.Cipher, error) {
+func (mock *Mock) AddAttachment(s1, s2 string, att ds.Attachment) (ds.Cipher, error) {
 	return ds.Cipher{}, nil
 }
 
@@ -30,7 +35,17 @@ func (mock *Mock) DeleteCipher(s1, s2 string) error {
 	return nil
 }
 
-func (mock *Mock) UpdateCipher(cipher ds.Cipher, s string) (ds.Cipher, error) {
+func (mock *Mock) GetCipher(s, cipherId string) (ds.Cipher, error) {
+	return ds.Cipher{
+		Id:           cipherId,
+		RevisionDate: RevisionDate,
+	}, nil
+}
+
+func (mock *Mock) UpdateCipher(cipher ds.Cipher, s string, lastKnown *time.Time) (ds.Cipher, error) {
+	if lastKnown != nil && RevisionDate.Unix() > lastKnown.Unix() {
+		return ds.Cipher{}, ds.ErrOutOfDate
+	}
 	return ds.Cipher{}, nil
 }
 
@@ -38,15 +53,31 @@ func (mock *Mock) AddCipher(cipher ds.Cipher, s string) (ds.Cipher, error) {
 	return ds.Cipher{}, nil
 }
 
-func (mock *Mock) RenameFolder(s1, s2 string) (ds.Folder, error) {
+func (mock *Mock) UpdateCipherPartial(s1, s2, s3 string, favorite bool) (ds.Cipher, error) {
+	return ds.Cipher{}, nil
+}
+
+func (mock *Mock) MoveCiphers(s1, s2 string, ids []string) error {
+	return nil
+}
+
+func (mock *Mock) ImportCiphers(s string, folders []ds.Folder, ciphers []ds.Cipher) error {
+	return nil
+}
+
+func (mock *Mock) GetFolder(s1, s2 string) (ds.Folder, error) {
 	return ds.Folder{}, nil
 }
 
-func (mock *Mock) DeleteFolder(s string) error {
+func (mock *Mock) RenameFolder(s1, s2, s3 string) (ds.Folder, error) {
+	return ds.Folder{}, nil
+}
+
+func (mock *Mock) DeleteFolder(s1, s2 string) error {
 	return nil
 }
 
-func (mock *Mock) GetAttachment(s1, s2 string) (ds.Attachment, error) {
+func (mock *Mock) GetAttachment(s1, s2, s3 string) (ds.Attachment, error) {
 	return ds.Attachment{}, nil
 }
 
@@ -64,9 +95,66 @@ func (mock *Mock) GetAccount(s string) (ds.Account, error) {
 		RefreshToken:  s,
 		Kdf:           0,
 		KdfIterations: 100000,
+		RevisionDate:  RevisionDate,
 	}, nil
 }
 
-func (mock *Mock) UpdateAccount(acc ds.Account) error {
+func (mock *Mock) UpdateMasterPasswordHash(s1, s2 string) error {
+	return nil
+}
+
+func (mock *Mock) CountEmailTokenAttempt(s string) (int, error) {
+	return 1, nil
+}
+
+func (mock *Mock) SetEmailToken(s1, s2, s3 string, expires time.Time) error {
+	return nil
+}
+
+func (mock *Mock) UpdateEmail(s1, s2, s3, s4 string) error {
+	return nil
+}
+
+func (mock *Mock) UpdateProfile(acc ds.Account) error {
+	return nil
+}
+
+func (mock *Mock) UpdateMasterPassword(s1, s2, s3, s4 string) error {
+	return nil
+}
+
+func (mock *Mock) RotateSecurityStamp(s string) error {
+	return nil
+}
+
+func (mock *Mock) UpdateKdf(acc ds.Account) error {
+	return nil
+}
+
+func (mock *Mock) DeleteAccount(s string) ([]string, error) {
+	return nil, nil
+}
+
+func (mock *Mock) PurgeVault(s string) ([]string, error) {
+	return nil, nil
+}
+
+func (mock *Mock) UpdateRefreshToken(s1, s2 string) error {
+	return nil
+}
+
+func (mock *Mock) UpdateKeys(s string, keys ds.Keys) error {
+	return nil
+}
+
+func (mock *Mock) GetStorageUsage(s string) (int64, error) {
+	return 0, nil
+}
+
+func (mock *Mock) GetStorageUsages() ([]ds.StorageUsage, error) {
+	return []ds.StorageUsage{}, nil
+}
+
+func (mock *Mock) UpdateDomains(s string, equivalent [][]string, excluded []int) error {
 	return nil
 }
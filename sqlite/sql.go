@@ -2,11 +2,13 @@ package sqlite
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 
 	"github.com/404cn/gowarden/utils"
 
@@ -29,11 +31,24 @@ const (
                         masterPasswordHint TEXT,
                         key INTEGER,
                         kdfIterations INTEGER,
+                        kdf INTEGER NOT NULL DEFAULT 0,
+                        kdfMemory INTEGER NOT NULL DEFAULT 0,
+                        kdfParallelism INTEGER NOT NULL DEFAULT 0,
+                        pendingEmail TEXT NOT NULL DEFAULT '',
+                        emailToken TEXT NOT NULL DEFAULT '',
+                        emailTokenExpires INTEGER NOT NULL DEFAULT 0,
+                        emailTokenAttempts INTEGER NOT NULL DEFAULT 0,
+                        culture TEXT NOT NULL DEFAULT 'en-US',
+                        avatarColor TEXT NOT NULL DEFAULT '',
+                        securityStamp TEXT NOT NULL DEFAULT '',
                         publicKey TEXT NOT NULL,
                         encryptedPrivateKey TEXT NOT NULL,
                         refreshToken TEXT,
+                        equivalentDomains TEXT NOT NULL DEFAULT '[]',
+                        excludedGlobalEquivalentDomains TEXT NOT NULL DEFAULT '[]',
+                        revisionDate INTEGER NOT NULL DEFAULT 0,
                         PRIMARY KEY(id)
-                    )`  // User's account table
+                    )` // User's account table
 	folderTable = `CREATE TABLE IF NOT EXISTS "folders" (
                         id TEXT,
                         name TEXT,
@@ -48,32 +63,8 @@ const (
                         type INTEGER,
                         folderId TEXT,
                         favorite INTEGER NOT NULL,
-						name TEXT,
-						notes TEXT,
-                        PRIMARY KEY(id)
-                    )`
-	loginTable = `CREATE TABLE IF NOT EXISTS "logins" (
-                        id TEXT,
-                        cipherId TEXT,
-						username TEXT,
-						password TEXT,
- 						totp TEXT,
-                        PRIMARY KEY(id)
-                    )`
-
-	uriTable = `CREATE TABLE IF NOT EXISTS "uris" (
-                        id TEXT,
-                        cipherId TEXT,
-						match INTEGER,
-						uri TEXT,
-                        PRIMARY KEY(id)
-                    )`
-	fieldTable = `CREATE TABLE IF NOT EXISTS "fields" (
-                        id TEXT,
-                        cipherId TEXT,
-						type INTEGER,
-						name TEXT,
-						value TEXT,
+                        dataVersion INTEGER NOT NULL,
+                        data TEXT NOT NULL,
                         PRIMARY KEY(id)
                     )`
 	attachmentTable = `CREATE TABLE IF NOT EXISTS "attachments" (
@@ -85,42 +76,15 @@ const (
 						url TEXT,
                         PRIMARY KEY(id)
                     )`
-	cardTable = `CREATE TABLE IF NOT EXISTS "cards" (
-                        id TEXT,
-                        cipherId TEXT,
-						cardholdername TEXT,
-						brand TEXT,
-						number TEXT,
-						expmonth TEXT,
-						expyear TEXT,
-						code TEXT,
-                        PRIMARY KEY(id)
-                    )`
-	identityTable = `CREATE TABLE IF NOT EXISTS "identities" (
-                        id TEXT,
-                        cipherId TEXT,
-						title TEXT,
-						firstname TEXT,
-						middlename TEXT,
-						lastname TEXT,
-						address1 TEXT,
-						address2 TEXT,
-						address3 TEXT,
-						city TEXT,
-						state TEXT,
-						postalcode TEXT,
-						country TEXT,
-						company TEXT,
-						email TEXT,
-						phone TEXT,
-						ssn TEXT,
-						username TEXT,
-						passportnumber TEXT,
-						licensenumber TEXT,
-                        PRIMARY KEY(id)
-                    )`
 )
 
+// Indexes for looking up a vault, attachments are always found through their cipher.
+var indexes = []string{
+	`CREATE INDEX IF NOT EXISTS ciphers_accountId ON ciphers(accountId)`,
+	`CREATE INDEX IF NOT EXISTS folders_accountId ON folders(accountId)`,
+	`CREATE INDEX IF NOT EXISTS attachments_cipherId ON attachments(cipherId)`,
+}
+
 type DB struct {
 	db  *sql.DB
 	dir string
@@ -148,22 +112,7 @@ func (db *DB) SaveCSV(csvs []ds.CSV, email string) error {
 		return err
 	}
 
-	cipherStmt, err := db.db.Prepare("INSERT INTO ciphers VALUES(?,?,?,?,?,?,?,?)")
-	if err != nil {
-		return err
-	}
-
-	loginStmt, err := db.db.Prepare("INSERT INTO logins VALUES(?,?,?,?,?)")
-	if err != nil {
-		return err
-	}
-
-	uriStmt, err := db.db.Prepare("INSERT INTO uris VALUES(?,?,?,?)")
-	if err != nil {
-		return err
-	}
-
-	fieldStmt, err := db.db.Prepare("INSERT INTO fields VALUES(?,?,?,?,?)")
+	cipherStmt, err := db.db.Prepare("INSERT INTO ciphers(id, accountId, revisionDate, type, folderId, favorite, dataVersion, data) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -174,13 +123,6 @@ func (db *DB) SaveCSV(csvs []ds.CSV, email string) error {
 			return err
 		}
 
-		var favorite int
-		if csv.Favorite {
-			favorite = 1
-		} else {
-			favorite = 0
-		}
-
 		cipherID := uuid.Must(uuid.NewRandom())
 		folderID := uuid.Must(uuid.NewRandom())
 
@@ -191,11 +133,6 @@ func (db *DB) SaveCSV(csvs []ds.CSV, email string) error {
 		for i, field := range csv.Fields {
 			csv.Fields[i].Name = utils.Encrypt(field.Name, encKey, macKey)
 			csv.Fields[i].Value = utils.Encrypt(field.Value, encKey, macKey)
-
-			_, err := fieldStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipherID, csv.Fields[i].Type, csv.Fields[i].Name, csv.Fields[i].Value)
-			if err != nil {
-				return err
-			}
 		}
 
 		csv.Login.Username = utils.Encrypt(csv.Login.Username, encKey, macKey)
@@ -203,17 +140,14 @@ func (db *DB) SaveCSV(csvs []ds.CSV, email string) error {
 		csv.Login.Totp = utils.Encrypt(csv.Login.Totp, encKey, macKey)
 		csv.Login.Uri = utils.Encrypt(csv.Login.Uri, encKey, macKey)
 
-		for i, uri := range csv.Login.Uris {
-			csv.Login.Uris[i].Uri = utils.Encrypt(uri.Uri, encKey, macKey)
-
-			if csv.Login.Uris[i].Uri != "" {
-				_, err := uriStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipherID, csv.Login.Uris[i].Match, csv.Login.Uris[i].Uri)
-				if err != nil {
-					return err
-				}
+		var uris []ds.Uri
+		for _, uri := range csv.Login.Uris {
+			uri.Uri = utils.Encrypt(uri.Uri, encKey, macKey)
+			if uri.Uri != "" {
+				uris = append(uris, uri)
 			}
-
 		}
+		csv.Login.Uris = uris
 
 		if csv.Folder.Name != "" {
 			_, err = folderStmt.Exec(folderID, csv.Folder.Name, now, accID)
@@ -222,21 +156,27 @@ func (db *DB) SaveCSV(csvs []ds.CSV, email string) error {
 			}
 		}
 
-		_, err = cipherStmt.Exec(cipherID, accID, now, cipherType, folderID, favorite, csv.Name, csv.Notes)
+		cipher := ds.Cipher{
+			Name:   csv.Name,
+			Notes:  csv.Notes,
+			Fields: csv.Fields,
+		}
+		if cipherType == 1 {
+			cipher.Login = csv.Login
+		}
+
+		data, err := marshalCipher(cipher)
 		if err != nil {
 			return err
 		}
 
-		if cipherType == 1 {
-			_, err = loginStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipherID, csv.Login.Username, csv.Login.Password, csv.Login.Totp)
-			if err != nil {
-				return err
-			}
+		_, err = cipherStmt.Exec(cipherID, accID, now, cipherType, folderID, csv.Favorite, cipherDataVersion, data)
+		if err != nil {
+			return err
 		}
-
 	}
 
-	return nil
+	return db.touchAccount(accID)
 }
 
 func getCipherType(t string) (int, error) {
@@ -250,10 +190,10 @@ func getCipherType(t string) (int, error) {
 	}
 }
 
-func (db *DB) AddAttachment(cipherId string, attachment ds.Attachment) (ds.Cipher, error) {
-	cipher, err := getCipher(db.db, cipherId)
+// AddAttachment adds attachment to a cipher of the account, sql.ErrNoRows if it has no such cipher.
+func (db *DB) AddAttachment(accId, cipherId string, attachment ds.Attachment) (ds.Cipher, error) {
+	cipher, err := db.GetCipher(accId, cipherId)
 	if err != nil {
-		// FIXME no rows in result sets
 		return cipher, err
 	}
 
@@ -276,33 +216,41 @@ func (db *DB) AddAttachment(cipherId string, attachment ds.Attachment) (ds.Ciphe
 
 	cipher.Attachments = append(cipher.Attachments, attachment)
 
+	err = db.touchAccount(accId)
+	if err != nil {
+		return cipher, err
+	}
+
 	return cipher, nil
 }
 
-func (db *DB) DeleteAttachment(cipherId, attachmentId string) (url string, err error) {
-	url, err = getAttachmentUrl(db.db, cipherId, attachmentId)
-	stmt, err := db.db.Prepare("DELETE FROM attachments WHERE id=$1 AND cipherID=$2")
+// DeleteAttachment removes an attachment of a cipher of the account, sql.ErrNoRows if it has no such attachment.
+func (db *DB) DeleteAttachment(accId, cipherId, attachmentId string) (url string, err error) {
+	attachment, err := db.GetAttachment(accId, cipherId, attachmentId)
 	if err != nil {
 		return "", err
 	}
 
-	_, err = stmt.Exec(attachmentId, cipherId)
+	_, err = db.db.Exec("DELETE FROM attachments WHERE id=$1 AND cipherID=$2", attachmentId, cipherId)
 	if err != nil {
 		return "", err
 	}
 
-	return url, nil
-}
+	err = db.touchAccount(accId)
+	if err != nil {
+		return "", err
+	}
 
-func getAttachmentUrl(db *sql.DB, cipherId, attachmentId string) (url string, err error) {
-	err = db.QueryRow("SELECT url FROM attachments WHERE id=$1 AND cipherId=$2", attachmentId, cipherId).Scan(&url)
-	return url, err
+	return attachment.Url, nil
 }
 
-func (db *DB) GetAttachment(cipherId, attachmentId string) (ds.Attachment, error) {
+// GetAttachment returns an attachment of a cipher of the account, sql.ErrNoRows if it has no such attachment.
+func (db *DB) GetAttachment(accId, cipherId, attachmentId string) (ds.Attachment, error) {
 	var attachment ds.Attachment
 
-	err := db.db.QueryRow("SELECT id, filename, key, size, url FROM attachments WHERE cipherId=$1", cipherId).Scan(&attachment.Id, &attachment.FileName, &attachment.Key, &attachment.Size, &attachment.Url)
+	err := db.db.QueryRow(`SELECT attachments.id, attachments.filename, attachments.key, attachments.size, attachments.url
+                           FROM attachments INNER JOIN ciphers ON attachments.cipherId=ciphers.id
+                           WHERE attachments.id=$1 AND attachments.cipherId=$2 AND ciphers.accountId=$3`, attachmentId, cipherId, accId).Scan(&attachment.Id, &attachment.FileName, &attachment.Key, &attachment.Size, &attachment.Url)
 	if err != nil {
 		return attachment, err
 	}
@@ -317,6 +265,43 @@ func (db *DB) GetAttachment(cipherId, attachmentId string) (ds.Attachment, error
 	return attachment, nil
 }
 
+// GetStorageUsage returns the total size in bytes of all attachments of an account.
+func (db *DB) GetStorageUsage(accId string) (int64, error) {
+	var used int64
+
+	err := db.db.QueryRow("SELECT COALESCE(SUM(CAST(attachments.size AS INTEGER)), 0) FROM attachments INNER JOIN ciphers ON attachments.cipherId=ciphers.id WHERE ciphers.accountId=$1", accId).Scan(&used)
+
+	return used, err
+}
+
+// GetStorageUsages returns the attachment storage of every account.
+func (db *DB) GetStorageUsages() ([]ds.StorageUsage, error) {
+	usages := make([]ds.StorageUsage, 0)
+
+	rows, err := db.db.Query(`SELECT accounts.id, accounts.email, COUNT(attachments.id), COALESCE(SUM(CAST(attachments.size AS INTEGER)), 0)
+                              FROM accounts
+                              LEFT JOIN ciphers ON ciphers.accountId=accounts.id
+                              LEFT JOIN attachments ON attachments.cipherId=ciphers.id
+                              GROUP BY accounts.id ORDER BY accounts.email`)
+	if err != nil {
+		return usages, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		usage := ds.StorageUsage{Object: "storageUsage"}
+
+		err = rows.Scan(&usage.AccountId, &usage.Email, &usage.Attachments, &usage.Used)
+		if err != nil {
+			return usages, err
+		}
+
+		usages = append(usages, usage)
+	}
+
+	return usages, rows.Err()
+}
+
 func getAttachments(db *DB, cipherId string) ([]ds.Attachment, error) {
 	var attachments []ds.Attachment
 
@@ -347,532 +332,381 @@ func makeNewAttachment(attachment *ds.Attachment) {
 	attachment.SizeName = strconv.FormatInt(int64(size>>10), 10) + " KB"
 }
 
-func (db *DB) AddCipher(cipher ds.Cipher, accId string) (ds.Cipher, error) {
+// execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertCipher saves cipher as a new cipher of the account, setting its id and revision date.
+func insertCipher(db execer, cipher *ds.Cipher, accId string) error {
 	cipher.Id = uuid.Must(uuid.NewRandom()).String()
 	cipher.RevisionDate = time.Now()
-	var favorite int
-
-	if cipher.Favorite {
-		favorite = 1
-	}
 
-	cipherStmt, err := db.db.Prepare("INSERT INTO ciphers VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
+	data, err := marshalCipher(*cipher)
 	if err != nil {
-		return cipher, nil
-	}
-
-	if cipher.Type == 1 {
-		loginStmt, err := db.db.Prepare("INSERT INTO logins VALUES(?, ?, ?, ?, ?)")
-		if err != nil {
-			return cipher, nil
-		}
-		// Add totp in 2020 05 24 2:12
-		_, err = loginStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipher.Id, cipher.Login.Username, cipher.Login.Password, cipher.Login.Totp)
-		if err != nil {
-			return cipher, nil
-		}
+		return err
 	}
 
-	uriStmt, err := db.db.Prepare("INSERT INTO uris VALUES(?, ?, ?, ?)")
-	if err != nil {
-		return cipher, nil
-	}
+	_, err = db.Exec("INSERT INTO ciphers(id, accountId, revisionDate, type, folderId, favorite, dataVersion, data) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		cipher.Id, accId, cipher.RevisionDate.Unix(), cipher.Type, cipher.FolderId, cipher.Favorite, cipherDataVersion, data)
+	return err
+}
 
-	fieldStmt, err := db.db.Prepare("INSERT INTO fields VALUES(?, ?, ?, ?, ?)")
+func (db *DB) AddCipher(cipher ds.Cipher, accId string) (ds.Cipher, error) {
+	err := insertCipher(db.db, &cipher, accId)
 	if err != nil {
-		return cipher, nil
+		return cipher, err
 	}
 
-	_, err = cipherStmt.Exec(cipher.Id, accId, cipher.RevisionDate.Unix(), cipher.Type, cipher.FolderId, favorite, cipher.Name, cipher.Notes)
+	err = db.touchAccount(accId)
 	if err != nil {
-		return cipher, nil
-	}
-
-	for _, uri := range cipher.Login.Uris {
-		_, err = uriStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipher.Id, uri.Match, uri.Uri)
-		if err != nil {
-			return cipher, nil
-		}
-	}
-
-	for _, field := range cipher.Fields {
-		_, err = fieldStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipher.Id, field.Type, field.Name, field.Value)
-		if err != nil {
-			return cipher, nil
-		}
-	}
-
-	if cipher.Type == 3 {
-		cardStmt, err := db.db.Prepare("INSERT INTO cards VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
-		if err != nil {
-			return cipher, err
-		}
-		_, err = cardStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipher.Id, cipher.Card.CardholderName, cipher.Card.Brand, cipher.Card.Number, cipher.Card.ExpMonth, cipher.Card.ExpYear, cipher.Card.Code)
-		if err != nil {
-			return cipher, err
-		}
-	}
-
-	if cipher.Type == 4 {
-		identityStmt, err := db.db.Prepare("INSERT INTO identities VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? ,? ,? ,?,?,?,?,?,?)")
-		if err != nil {
-			return cipher, err
-		}
-		_, err = identityStmt.Exec(
-			uuid.Must(uuid.NewRandom()).String(),
-			cipher.Id,
-			cipher.Identity.Title,
-			cipher.Identity.FirstName,
-			cipher.Identity.MiddleName,
-			cipher.Identity.LastName,
-			cipher.Identity.Address1,
-			cipher.Identity.Address2,
-			cipher.Identity.Address3,
-			cipher.Identity.City,
-			cipher.Identity.State,
-			cipher.Identity.PostalCode,
-			cipher.Identity.Country,
-			cipher.Identity.Company,
-			cipher.Identity.Email,
-			cipher.Identity.Phone,
-			cipher.Identity.SSN,
-			cipher.Identity.Username,
-			cipher.Identity.PassportNumber,
-			cipher.Identity.LicenseNumber)
-		if err != nil {
-			return cipher, err
-		}
+		return cipher, err
 	}
 
 	makeNewCipher(&cipher)
 	return cipher, nil
 }
 
+// DeleteCipher removes a cipher of the account, sql.ErrNoRows if it has no such cipher.
 func (db *DB) DeleteCipher(accId, cipherId string) error {
-	cipherStmt, err := db.db.Prepare("DELETE FROM ciphers WHERE id=$1 AND accountId=$2")
+	res, err := db.db.Exec("DELETE FROM ciphers WHERE id=$1 AND accountId=$2", cipherId, accId)
 	if err != nil {
 		return err
 	}
 
-	_, err = cipherStmt.Exec(cipherId, accId)
-	if err != nil {
+	// Only touch attachments of ciphers the account owns.
+	if err = affected(res); err != nil {
 		return err
 	}
 
-	loginStmt, err := db.db.Prepare("DELETE FROM logins WHERE cipherId=$1")
+	_, err = db.db.Exec("DELETE FROM attachments WHERE cipherId=$1", cipherId)
 	if err != nil {
 		return err
 	}
 
-	_, err = loginStmt.Exec(cipherId)
-	if err != nil {
-		return err
-	}
+	return db.touchAccount(accId)
+}
 
-	uriStmt, err := db.db.Prepare("DELETE FROM uris WHERE cipherId=$1")
-	if err != nil {
-		return err
-	}
+// UpdateCipher replaces a cipher of the account, sql.ErrNoRows if it has no
+// such cipher. Unless lastKnown is nil the cipher must not have changed after
+// it, ds.ErrOutOfDate otherwise. Revision dates are stored with second precision.
+func (db *DB) UpdateCipher(cipher ds.Cipher, accId string, lastKnown *time.Time) (ds.Cipher, error) {
+	cipher.RevisionDate = time.Now()
 
-	_, err = uriStmt.Exec(cipherId)
+	data, err := marshalCipher(cipher)
 	if err != nil {
-		return err
+		return cipher, err
 	}
 
-	fieldStmt, err := db.db.Prepare("DELETE FROM fields WHERE cipherId=$1")
-	if err != nil {
-		return err
+	// Check the revision in the UPDATE, so no other update can slip in between.
+	query := "UPDATE ciphers SET revisionDate=$1, type=$2, folderId=$3, favorite=$4, dataVersion=$5, data=$6 WHERE id=$7 AND accountId=$8"
+	args := []interface{}{cipher.RevisionDate.Unix(), cipher.Type, cipher.FolderId, cipher.Favorite, cipherDataVersion, data, cipher.Id, accId}
+	if lastKnown != nil {
+		query += " AND revisionDate<=$9"
+		args = append(args, lastKnown.Unix())
 	}
 
-	_, err = fieldStmt.Exec(cipherId)
+	res, err := db.db.Exec(query, args...)
 	if err != nil {
-		return err
+		return cipher, err
 	}
 
-	attachmentStmt, err := db.db.Prepare("DELETE FROM attachments WHERE cipherId=$1")
-	if err != nil {
-		return err
+	err = affected(res)
+	if err == sql.ErrNoRows && lastKnown != nil {
+		if _, err = db.GetCipher(accId, cipher.Id); err == nil {
+			err = ds.ErrOutOfDate
+		}
 	}
-	_, err = attachmentStmt.Exec(cipherId)
 	if err != nil {
-		return err
+		return cipher, err
 	}
 
-	cardStmt, err := db.db.Prepare("DELETE FROM cards WHERE cipherId=$1")
-	if err != nil {
-		return err
-	}
-	_, err = cardStmt.Exec(cipherId)
+	cipher.Attachments, err = getAttachments(db, cipher.Id)
 	if err != nil {
-		return err
+		return cipher, err
 	}
 
-	_, err = db.db.Exec("DELETE FROM identities WHERE cipherId=$1", cipherId)
+	err = db.touchAccount(accId)
 	if err != nil {
-		return err
+		return cipher, err
 	}
 
-	return nil
+	makeNewCipher(&cipher)
+	return cipher, nil
 }
 
-func (db *DB) UpdateCipher(cipher ds.Cipher, accId string) (ds.Cipher, error) {
-	cipher.RevisionDate = time.Now()
-	favorite := 0
-	if cipher.Favorite {
-		favorite = 1
-	}
-
-	cipherStmt, err := db.db.Prepare("UPDATE ciphers SET revisionDate=$1, type=$2, folderId=$3, favorite=$4, name=$5, notes=$6 WHERE id=$7 AND accountId=$8")
+// UpdateCipherPartial only changes the folder and favorite flag of a cipher of
+// the account, sql.ErrNoRows if it has no such cipher.
+func (db *DB) UpdateCipherPartial(accId, cipherId, folderId string, favorite bool) (ds.Cipher, error) {
+	res, err := db.db.Exec("UPDATE ciphers SET folderId=$1, favorite=$2, revisionDate=$3 WHERE id=$4 AND accountId=$5",
+		folderId, favorite, time.Now().Unix(), cipherId, accId)
 	if err != nil {
-		return cipher, err
+		return ds.Cipher{}, err
 	}
 
-	_, err = cipherStmt.Exec(cipher.RevisionDate.Unix(), cipher.Type, cipher.FolderId, favorite, cipher.Name, cipher.Notes, cipher.Id, accId)
-	if err != nil {
-		return cipher, err
+	if err = affected(res); err != nil {
+		return ds.Cipher{}, err
 	}
 
-	loginStmt, err := db.db.Prepare("UPDATE logins SET username=$1, password=$2, totp=$3 WHERE cipherId=$4")
+	err = db.touchAccount(accId)
 	if err != nil {
-		return cipher, err
+		return ds.Cipher{}, err
 	}
 
-	_, err = loginStmt.Exec(cipher.Login.Username, cipher.Login.Password, cipher.Login.Totp, cipher.Id)
-	if err != nil {
-		return cipher, err
-	}
+	return db.GetCipher(accId, cipherId)
+}
 
-	_, err = db.db.Exec("DELETE FROM uris WHERE cipherId=$1", cipher.Id)
+// MoveCiphers puts ciphers of the account into a folder, or out of any folder
+// if folderId is "". Only the folder changes, the content stays as it is.
+func (db *DB) MoveCiphers(accId, folderId string, cipherIds []string) error {
+	tx, err := db.db.Begin()
 	if err != nil {
-		return cipher, err
+		return err
 	}
-	uriStmt, err := db.db.Prepare("INSERT INTO uris VALUES (?, ?, ? ,?)")
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE ciphers SET folderId=$1, revisionDate=$2 WHERE id=$3 AND accountId=$4")
 	if err != nil {
-		return cipher, err
+		return err
 	}
+	defer stmt.Close()
 
-	for _, uri := range cipher.Login.Uris {
-		_, err = uriStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipher.Id, uri.Match, uri.Uri)
+	now := time.Now().Unix()
+	for _, cipherId := range cipherIds {
+		_, err = stmt.Exec(folderId, now, cipherId, accId)
 		if err != nil {
-			return cipher, err
+			return err
 		}
 	}
 
-	_, err = db.db.Exec("DELETE FROM fields WHERE cipherId=$1", cipher.Id)
+	_, err = tx.Exec("UPDATE accounts SET revisionDate=$1 WHERE id=$2", revisionNow(), accId)
 	if err != nil {
-		return cipher, err
+		return err
 	}
-	fieldStmt, err := db.db.Prepare("INSERT INTO fields VALUES (?, ?, ?, ?, ?)")
+
+	return tx.Commit()
+}
+
+// ImportCiphers adds folders and ciphers to the account all at once, ciphers
+// refer to the imported folders by the ids already set in folders.
+func (db *DB) ImportCiphers(accId string, folders []ds.Folder, ciphers []ds.Cipher) error {
+	tx, err := db.db.Begin()
 	if err != nil {
-		return cipher, err
+		return err
 	}
+	defer tx.Rollback()
 
-	for _, field := range cipher.Fields {
-		_, err = fieldStmt.Exec(uuid.Must(uuid.NewRandom()).String(), cipher.Id, field.Type, field.Name, field.Value)
+	now := time.Now().Unix()
+	for _, folder := range folders {
+		_, err = tx.Exec("INSERT INTO folders (id, name, revisionDate, accountId) VALUES(?, ?, ?, ?)", folder.Id, folder.Name, now, accId)
 		if err != nil {
-			return cipher, err
+			return err
 		}
 	}
 
-	cipher.Attachments, err = getAttachments(db, cipher.Id)
-	if err != nil {
-		return cipher, err
-	}
-
-	cardStmt, err := db.db.Prepare("UPDATE cards SET cardholdername=$1, brand=$2, number=$3, expmonth=$4, expyear=$5, code=$6 WHERE cipherId=$7")
-	if err != nil {
-		return cipher, err
-	}
-	_, err = cardStmt.Exec(cipher.Card.CardholderName, cipher.Card.Brand, cipher.Card.Number, cipher.Card.ExpMonth, cipher.Card.ExpYear, cipher.Card.Code, cipher.Id)
-	if err != nil {
-		return cipher, err
+	for i := range ciphers {
+		err = insertCipher(tx, &ciphers[i], accId)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = db.db.Exec("UPDATE identities SET title=$1, firstname=$2, middlename=$3, lastname=$4, address1=$5, address2=$6, address3=$7, city=$8, state=$9, postalcode=$10, country=$11, company=$12, email=$13, phone=$14, ssn=$15, username=$16, passportnumber=$17, licensenumber=$18 WHERE cipherId=$19",
-		cipher.Identity.Title,
-		cipher.Identity.FirstName,
-		cipher.Identity.MiddleName,
-		cipher.Identity.LastName,
-		cipher.Identity.Address1,
-		cipher.Identity.Address2,
-		cipher.Identity.Address3,
-		cipher.Identity.City,
-		cipher.Identity.State,
-		cipher.Identity.PostalCode,
-		cipher.Identity.Country,
-		cipher.Identity.Company,
-		cipher.Identity.Email,
-		cipher.Identity.Phone,
-		cipher.Identity.SSN,
-		cipher.Identity.Username,
-		cipher.Identity.PassportNumber,
-		cipher.Identity.LicenseNumber,
-		cipher.Id)
+	_, err = tx.Exec("UPDATE accounts SET revisionDate=$1 WHERE id=$2", revisionNow(), accId)
 	if err != nil {
-		return cipher, err
+		return err
 	}
 
-	return cipher, nil
+	return tx.Commit()
 }
 
+// GetCiphers loads the whole vault of an account with one query for the
+// ciphers and one for their attachments.
 func (db *DB) GetCiphers(accId string) ([]ds.Cipher, error) {
 	var ciphers []ds.Cipher
-	var cipherId string
-	// 占位使用
-	var fooId string
+	// Index of each cipher in ciphers.
+	index := make(map[string]int)
 
-	db.db.QueryRow("SELECT DISTINCT id FROM ciphers WHERE accountId=$1", accId).Scan(&cipherId)
-
-	cipherRows, err := db.db.Query("SELECT * FROM ciphers WHERE accountId=$1", accId)
+	cipherRows, err := db.db.Query("SELECT "+cipherColumns+" FROM ciphers WHERE accountId=$1", accId)
 	if err != nil {
 		return ciphers, err
 	}
+	defer cipherRows.Close()
 
 	for cipherRows.Next() {
-		var cipher ds.Cipher
-		var revDate int64
-		var favorite int
-
-		err = cipherRows.Scan(&cipher.Id, &fooId, &revDate, &cipher.Type, &cipher.FolderId, &favorite, &cipher.Name, &cipher.Notes)
+		cipher, err := scanCipher(cipherRows)
 		if err != nil {
 			return ciphers, err
 		}
 
-		if favorite == 1 {
-			cipher.Favorite = true
-		}
-
-		cipher.RevisionDate = time.Unix(revDate, 0)
-
+		index[cipher.Id] = len(ciphers)
 		ciphers = append(ciphers, cipher)
 	}
+	if err = cipherRows.Err(); err != nil {
+		return ciphers, err
+	}
 
-	for i, cipher := range ciphers {
-		loginRow := db.db.QueryRow("SELECT username, password, totp FROM logins WHERE cipherId=$1", cipher.Id)
-
-		err = loginRow.Scan(&cipher.Login.Username, &cipher.Login.Password, &cipher.Login.Totp)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				return ciphers, err
-			}
-		}
-
-		uriRows, err := db.db.Query("SELECT match, uri FROM uris WHERE cipherId=$1", cipher.Id)
-		if err != nil {
-			return ciphers, err
-		}
-		var uris []ds.Uri
-		for uriRows.Next() {
-			var uri ds.Uri
-			err := uriRows.Scan(&uri.Match, &uri.Uri)
-			if err != nil {
-				return ciphers, err
-			}
-			uris = append(uris, uri)
-		}
-		cipher.Login.Uris = uris
+	attachmentRows, err := db.db.Query("SELECT attachments.cipherId, attachments.id, attachments.filename, attachments.key, attachments.size, attachments.url FROM attachments INNER JOIN ciphers ON attachments.cipherId=ciphers.id WHERE ciphers.accountId=$1", accId)
+	if err != nil {
+		return ciphers, err
+	}
+	defer attachmentRows.Close()
 
-		fieldRows, err := db.db.Query("SELECT type, name, value FROM fields WHERE cipherId=$1", cipher.Id)
+	for attachmentRows.Next() {
+		var cipherId string
+		var attachment ds.Attachment
+		err = attachmentRows.Scan(&cipherId, &attachment.Id, &attachment.FileName, &attachment.Key, &attachment.Size, &attachment.Url)
 		if err != nil {
 			return ciphers, err
 		}
+		makeNewAttachment(&attachment)
 
-		var fields []ds.Field
-		for fieldRows.Next() {
-			var field ds.Field
+		cipher := &ciphers[index[cipherId]]
+		cipher.Attachments = append(cipher.Attachments, attachment)
+	}
+	if err = attachmentRows.Err(); err != nil {
+		return ciphers, err
+	}
 
-			err = fieldRows.Scan(&field.Type, &field.Name, &field.Value)
-			if err != nil {
-				return ciphers, err
-			}
+	for i := range ciphers {
+		makeNewCipher(&ciphers[i])
+	}
 
-			fields = append(fields, field)
-		}
-		cipher.Fields = fields
+	return ciphers, nil
+}
 
-		attachmentRows, err := db.db.Query("SELECT id, filename, key, size, url FROM attachments WHERE cipherId=$1", cipher.Id)
-		if err != nil {
-			return ciphers, err
-		}
-		var attachments []ds.Attachment
-		for attachmentRows.Next() {
-			var attachment ds.Attachment
-			err = attachmentRows.Scan(&attachment.Id, &attachment.FileName, &attachment.Key, &attachment.Size, &attachment.Url)
-			if err != nil {
-				return ciphers, err
-			}
-			attachment.Object = "attachment"
-			size, err := strconv.Atoi(attachment.Size)
-			if err != nil {
-				return ciphers, err
-			}
-			attachment.SizeName = strconv.FormatInt(int64(size>>10), 10) + " KB"
-			attachments = append(attachments, attachment)
-		}
-		cipher.Attachments = attachments
+// GetCipher returns a cipher of the account, sql.ErrNoRows if it has no such cipher.
+func (db *DB) GetCipher(accId, cipherId string) (ds.Cipher, error) {
+	return db.loadCipher(db.db.QueryRow("SELECT "+cipherColumns+" FROM ciphers WHERE id=$1 AND accountId=$2", cipherId, accId))
+}
 
-		err = db.db.QueryRow("SELECT cardholdername, brand, number, expmonth, expyear, code FROM cards WHERE cipherId=$1", cipher.Id).Scan(&cipher.Card.CardholderName, &cipher.Card.Brand, &cipher.Card.Number, &cipher.Card.ExpMonth, &cipher.Card.ExpYear, &cipher.Card.Code)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				return ciphers, err
-			}
-		}
+// loadCipher scans a cipher from row and loads its attachments.
+func (db *DB) loadCipher(row *sql.Row) (ds.Cipher, error) {
+	cipher, err := scanCipher(row)
+	if err != nil {
+		return cipher, err
+	}
 
-		var foo, bar string
-		err = db.db.QueryRow("SELECT * FROM identities WHERE cipherId=$1", cipher.Id).Scan(
-			&foo,
-			&bar,
-			&cipher.Identity.Title,
-			&cipher.Identity.FirstName,
-			&cipher.Identity.MiddleName,
-			&cipher.Identity.LastName,
-			&cipher.Identity.Address1,
-			&cipher.Identity.Address2,
-			&cipher.Identity.Address3,
-			&cipher.Identity.City,
-			&cipher.Identity.State,
-			&cipher.Identity.PostalCode,
-			&cipher.Identity.Country,
-			&cipher.Identity.Company,
-			&cipher.Identity.Email,
-			&cipher.Identity.Phone,
-			&cipher.Identity.SSN,
-			&cipher.Identity.Username,
-			&cipher.Identity.PassportNumber,
-			&cipher.Identity.LicenseNumber)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				return ciphers, err
-			}
-		}
+	cipher.Attachments, err = getAttachments(db, cipher.Id)
+	if err != nil {
+		return cipher, err
+	}
 
-		makeNewCipher(&cipher)
+	makeNewCipher(&cipher)
 
-		ciphers[i] = cipher
-	}
+	return cipher, nil
+}
 
-	return ciphers, nil
+// Version of the documents in ciphers.data written by this gowarden. Version
+// 2 added PasswordHistory, version 1 kept it in Extra.
+const cipherDataVersion = 2
+
+// cipherDocument is the encrypted content of a cipher, stored as json in
+// ciphers.data. Like the tables it replaced it only holds the part of the
+// item type, members sent by clients that gowarden doesn't know end up in the
+// Extra maps and are stored along.
+type cipherDocument struct {
+	Name            string
+	Notes           string
+	Fields          []ds.Field           `json:",omitempty"`
+	PasswordHistory []ds.PasswordHistory `json:",omitempty"`
+	Login           *ds.Login            `json:",omitempty"`
+	SecureNote      *ds.SecureNote       `json:",omitempty"`
+	Card            *ds.Card             `json:",omitempty"`
+	Identity        *ds.Identity         `json:",omitempty"`
+	Extra           ds.Extra             `json:",omitempty"`
 }
 
-func getCipher(db *sql.DB, cipherId string) (ds.Cipher, error) {
-	var cipher ds.Cipher
-	var revDate int64
-	var favorite int
+func marshalCipher(cipher ds.Cipher) (string, error) {
+	doc := cipherDocument{
+		Name:            cipher.Name,
+		Notes:           cipher.Notes,
+		Fields:          cipher.Fields,
+		PasswordHistory: cipher.PasswordHistory,
+		Extra:           cipher.Extra,
+	}
 
-	// TODO error wrapper , insert stack to message
-	cipher.Id = cipherId
+	switch cipher.Type {
+	case 1:
+		doc.Login = &cipher.Login
+	case 2:
+		doc.SecureNote = &cipher.SecureNote
+	case 3:
+		doc.Card = &cipher.Card
+	case 4:
+		doc.Identity = &cipher.Identity
+	}
 
-	db.QueryRow("SELECT revisionDate, type, folderId, favorite, name, notes FROM ciphere WHERE id=$1", cipherId).Scan(&revDate, &cipher.Type, &cipher.FolderId, &favorite, &cipher.Name, &cipher.Notes)
+	data, err := json.Marshal(&doc)
+	return string(data), err
+}
 
-	cipher.RevisionDate = time.Unix(revDate, 0)
-	if favorite == 1 {
-		cipher.Favorite = true
-	}
+// Columns scanned by scanCipher.
+const cipherColumns = "id, revisionDate, type, folderId, favorite, dataVersion, data"
 
-	loginRow := db.QueryRow("SELECT username, password, totp FROM logins WHERE cipherId=$1", cipher.Id)
+// scanner is a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
 
-	err := loginRow.Scan(&cipher.Login.Username, &cipher.Login.Password, &cipher.Login.Totp)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			return cipher, err
-		}
-	}
+func scanCipher(row scanner) (ds.Cipher, error) {
+	var cipher ds.Cipher
+	var revDate int64
+	var version int
+	var data string
 
-	uriRows, err := db.Query("SELECT match, uri FROM uris WHERE cipherId=$1", cipher.Id)
+	err := row.Scan(&cipher.Id, &revDate, &cipher.Type, &cipher.FolderId, &cipher.Favorite, &version, &data)
 	if err != nil {
 		return cipher, err
 	}
-	var uris []ds.Uri
-	for uriRows.Next() {
-		var uri ds.Uri
-		err := uriRows.Scan(&uri.Match, &uri.Uri)
-		if err != nil {
-			return cipher, err
-		}
-		uris = append(uris, uri)
+
+	cipher.RevisionDate = time.Unix(revDate, 0)
+
+	if version > cipherDataVersion {
+		return cipher, fmt.Errorf("cipher %s was saved by a newer version of gowarden", cipher.Id)
 	}
-	cipher.Login.Uris = uris
 
-	fieldRows, err := db.Query("SELECT type, name, value FROM fields WHERE cipherId=$1", cipher.Id)
+	var doc cipherDocument
+	err = json.Unmarshal([]byte(data), &doc)
 	if err != nil {
 		return cipher, err
 	}
 
-	var fields []ds.Field
-	for fieldRows.Next() {
-		var field ds.Field
-
-		err = fieldRows.Scan(&field.Type, &field.Name, &field.Value)
+	if version < 2 {
+		err = liftExtra(doc.Extra, "PasswordHistory", &doc.PasswordHistory)
 		if err != nil {
 			return cipher, err
 		}
-
-		fields = append(fields, field)
 	}
 
-	cipher.Fields = fields
-
-	attachmentRows, err := db.Query("SELECT id, filename, key, size, url FROM attachments WHERE cipherId=$1", cipher.Id)
-	if err != nil {
-		return cipher, err
+	cipher.Name, cipher.Notes, cipher.Fields, cipher.Extra = doc.Name, doc.Notes, doc.Fields, doc.Extra
+	cipher.PasswordHistory = doc.PasswordHistory
+	if doc.Login != nil {
+		cipher.Login = *doc.Login
 	}
-	var attachments []ds.Attachment
-	for attachmentRows.Next() {
-		var attachment ds.Attachment
-		err = attachmentRows.Scan(&attachment.Id, &attachment.FileName, &attachment.Key, &attachment.Size, &attachment.Url)
-		if err != nil {
-			return cipher, err
-		}
-		attachment.Object = "attachment"
-		size, err := strconv.Atoi(attachment.Size)
-		if err != nil {
-			return cipher, err
-		}
-		attachment.SizeName = strconv.FormatInt(int64(size>>10), 10) + " KB"
-		attachments = append(attachments, attachment)
+	if doc.SecureNote != nil {
+		cipher.SecureNote = *doc.SecureNote
 	}
-	cipher.Attachments = attachments
-
-	err = db.QueryRow("SELECT cardholdername, brand, number, expmonth, expyear, code FROM cards WHERE cipherId=$1", cipher.Id).Scan(&cipher.Card.CardholderName, &cipher.Card.Brand, &cipher.Card.Number, &cipher.Card.ExpMonth, &cipher.Card.ExpYear, &cipher.Card.Code)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			return cipher, err
-		}
+	if doc.Card != nil {
+		cipher.Card = *doc.Card
 	}
-
-	var foo, bar string
-	err = db.QueryRow("SELECT * FROM identities WHERE cipherId=$1", cipher.Id).Scan(
-		&foo,
-		&bar,
-		&cipher.Identity.Title,
-		&cipher.Identity.FirstName,
-		&cipher.Identity.MiddleName,
-		&cipher.Identity.LastName,
-		&cipher.Identity.Address1,
-		&cipher.Identity.Address2,
-		&cipher.Identity.Address3,
-		&cipher.Identity.City,
-		&cipher.Identity.State,
-		&cipher.Identity.PostalCode,
-		&cipher.Identity.Country,
-		&cipher.Identity.Company,
-		&cipher.Identity.Email,
-		&cipher.Identity.Phone,
-		&cipher.Identity.SSN,
-		&cipher.Identity.Username,
-		&cipher.Identity.PassportNumber,
-		&cipher.Identity.LicenseNumber)
-	if err != nil {
-		if err != sql.ErrNoRows {
-			return cipher, err
-		}
+	if doc.Identity != nil {
+		cipher.Identity = *doc.Identity
 	}
 
-	makeNewCipher(&cipher)
-
 	return cipher, nil
 }
 
+// liftExtra moves the member name of extra, known by now, into v.
+func liftExtra(extra ds.Extra, name string, v interface{}) error {
+	for member, value := range extra {
+		if strings.EqualFold(member, name) {
+			delete(extra, member)
+			return json.Unmarshal(value, v)
+		}
+	}
+	return nil
+}
+
 func makeNewCipher(cipher *ds.Cipher) {
 	cipher.Object = "cipher"
 	cipher.Edit = true
@@ -914,6 +748,7 @@ func (db *DB) GetFolders(accId string) ([]ds.Folder, error) {
 		}
 
 		folder.RevisionDate = time.Unix(revData, 0)
+		folder.Object = "folder"
 
 		folders = append(folders, folder)
 	}
@@ -924,22 +759,137 @@ func (db *DB) GetFolders(accId string) ([]ds.Folder, error) {
 	return folders, err
 }
 
-func (db *DB) DeleteFolder(folderUUID string) error {
-	stmt, err := db.db.Prepare("DELETE FROM folders WHERE id=$1")
+// GetFolder returns a folder of the account, sql.ErrNoRows if it has no such folder.
+func (db *DB) GetFolder(accId, folderUUID string) (ds.Folder, error) {
+	folder := ds.Folder{Object: "folder"}
+	var revDate int64
+
+	err := db.db.QueryRow("SELECT id, name, revisionDate FROM folders WHERE id=$1 AND accountId=$2", folderUUID, accId).
+		Scan(&folder.Id, &folder.Name, &revDate)
+	if err != nil {
+		return ds.Folder{}, err
+	}
+
+	folder.RevisionDate = time.Unix(revDate, 0)
+	return folder, nil
+}
+
+// DeleteFolder removes a folder of the account, sql.ErrNoRows if it has no such folder.
+// Ciphers in the folder are taken out of it and get a new revision date so
+// other devices pick the change up.
+func (db *DB) DeleteFolder(accId, folderUUID string) error {
+	tx, err := db.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = stmt.Exec(folderUUID)
+	res, err := tx.Exec("DELETE FROM folders WHERE id=$1 AND accountId=$2", folderUUID, accId)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if err = affected(res); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE ciphers SET folderId='', revisionDate=$1 WHERE folderId=$2 AND accountId=$3", time.Now().Unix(), folderUUID, accId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE accounts SET revisionDate=$1 WHERE id=$2", revisionNow(), accId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeVault deletes every folder, cipher and attachment of an account and
+// returns the ids of the deleted ciphers, whose attachment blobs are left to
+// the caller.
+func (db *DB) PurgeVault(accId string) ([]string, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	cipherIds, err := deleteVault(tx, accId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE accounts SET revisionDate=$1 WHERE id=$2", revisionNow(), accId)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipherIds, tx.Commit()
 }
 
-func (db *DB) RenameFolder(name, folderUUID string) (ds.Folder, error) {
-	stmt, err := db.db.Prepare("UPDATE folders SET name=$1, revisionDate=$2 WHERE id=$3")
+// DeleteAccount deletes an account with its whole vault like PurgeVault,
+// sql.ErrNoRows if there is no such account.
+func (db *DB) DeleteAccount(accId string) ([]string, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	cipherIds, err := deleteVault(tx, accId)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec("DELETE FROM accounts WHERE id=$1", accId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = affected(res); err != nil {
+		return nil, err
+	}
+
+	return cipherIds, tx.Commit()
+}
+
+func deleteVault(tx *sql.Tx, accId string) ([]string, error) {
+	rows, err := tx.Query("SELECT id FROM ciphers WHERE accountId=$1", accId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cipherIds []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		cipherIds = append(cipherIds, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range []string{
+		"DELETE FROM attachments WHERE cipherId IN (SELECT id FROM ciphers WHERE accountId=$1)",
+		"DELETE FROM ciphers WHERE accountId=$1",
+		"DELETE FROM folders WHERE accountId=$1",
+	} {
+		if _, err = tx.Exec(stmt, accId); err != nil {
+			return nil, err
+		}
+	}
+
+	return cipherIds, nil
+}
+
+// RenameFolder renames a folder of the account, sql.ErrNoRows if it has no such folder.
+func (db *DB) RenameFolder(accId, name, folderUUID string) (ds.Folder, error) {
+	stmt, err := db.db.Prepare("UPDATE folders SET name=$1, revisionDate=$2 WHERE id=$3 AND accountId=$4")
 	if err != nil {
 		return ds.Folder{}, err
 	}
@@ -953,7 +903,16 @@ func (db *DB) RenameFolder(name, folderUUID string) (ds.Folder, error) {
 		Object:       "folder",
 	}
 
-	_, err = stmt.Exec(name, tnow.Unix(), folderUUID)
+	res, err := stmt.Exec(name, tnow.Unix(), folderUUID, accId)
+	if err != nil {
+		return ds.Folder{}, err
+	}
+
+	if err = affected(res); err != nil {
+		return ds.Folder{}, err
+	}
+
+	err = db.touchAccount(accId)
 	if err != nil {
 		return ds.Folder{}, err
 	}
@@ -981,55 +940,241 @@ func (db *DB) AddFolder(accountId, name string) (ds.Folder, error) {
 		return ds.Folder{}, nil
 	}
 
+	err = db.touchAccount(accountId)
+	if err != nil {
+		return ds.Folder{}, err
+	}
+
 	return folder, nil
 }
 
-func (db *DB) UpdateAccount(acc ds.Account) error {
-	stmt, err := db.db.Prepare("UPDATE accounts SET refreshToken=$1, publicKey=$2, encryptedPrivateKey=$3 WHERE email=$4")
+// UpdateRefreshToken saves the refresh token of an account. Clients have
+// nothing new to sync, so the revision date stays.
+func (db *DB) UpdateRefreshToken(accId, refreshToken string) error {
+	res, err := db.db.Exec("UPDATE accounts SET refreshToken=$1 WHERE id=$2", refreshToken, accId)
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(acc.RefreshToken, acc.Keys.PublicKey, acc.Keys.EncryptedPrivateKey, acc.Email)
+	return affected(res)
+}
+
+// UpdateKeys saves the key pair of an account.
+func (db *DB) UpdateKeys(accId string, keys ds.Keys) error {
+	res, err := db.db.Exec("UPDATE accounts SET publicKey=$1, encryptedPrivateKey=$2, revisionDate=$3 WHERE id=$4",
+		keys.PublicKey, keys.EncryptedPrivateKey, revisionNow(), accId)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return affected(res)
 }
 
-func (db *DB) GetAccount(s string) (ds.Account, error) {
+// Columns scanned by scanAccount.
+const accountColumns = "id, name, email, masterPasswordHash, masterPasswordHint, key, kdf, kdfIterations, kdfMemory, kdfParallelism, publicKey, encryptedPrivateKey, refreshToken, equivalentDomains, excludedGlobalEquivalentDomains, revisionDate, pendingEmail, emailToken, emailTokenExpires, culture, avatarColor, securityStamp"
+
+func scanAccount(row *sql.Row) (ds.Account, error) {
 	var acc ds.Account
-	acc.Keys = ds.Keys{}
+	var equivalentDomains, excludedGlobalEquivalentDomains string
+	var revDate, tokenExpires int64
+
+	err := row.Scan(&acc.Id, &acc.Name, &acc.Email, &acc.MasterPasswordHash, &acc.MasterPasswordHint, &acc.Key, &acc.Kdf, &acc.KdfIterations, &acc.KdfMemory, &acc.KdfParallelism, &acc.Keys.PublicKey, &acc.Keys.EncryptedPrivateKey, &acc.RefreshToken, &equivalentDomains, &excludedGlobalEquivalentDomains, &revDate, &acc.PendingEmail, &acc.EmailToken, &tokenExpires, &acc.Culture, &acc.AvatarColor, &acc.SecurityStamp)
+	if err != nil {
+		return acc, err
+	}
+
+	acc.RevisionDate = time.Unix(0, revDate*int64(time.Millisecond))
+	acc.EmailTokenExpires = time.Unix(tokenExpires, 0)
+
+	err = json.Unmarshal([]byte(equivalentDomains), &acc.EquivalentDomains)
+	if err != nil {
+		return acc, err
+	}
+
+	err = json.Unmarshal([]byte(excludedGlobalEquivalentDomains), &acc.ExcludedGlobalEquivalentDomains)
+	return acc, err
+}
 
+func (db *DB) GetAccount(s string) (ds.Account, error) {
 	var validEmail = regexp.MustCompile(`(\w[-._\w]*\w@\w[-._\w]*\w\.\w{2,3})`)
 
 	if validEmail.MatchString(s) {
 		// Get account from email.
-		err := db.db.QueryRow("SELECT * FROM accounts WHERE email=?", s).Scan(&acc.Id, &acc.Name, &acc.Email, &acc.MasterPasswordHash, &acc.MasterPasswordHint, &acc.Key, &acc.KdfIterations, &acc.Keys.PublicKey, &acc.Keys.EncryptedPrivateKey, &acc.RefreshToken)
+		return scanAccount(db.db.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE email=?", s))
+	}
 
-		if err != nil {
-			return acc, err
-		}
-	} else {
-		// Get account from refresh token.
-		err := db.db.QueryRow("SELECT * FROM accounts WHERE refreshToken=?", s).Scan(&acc.Id, &acc.Name, &acc.Email, &acc.MasterPasswordHash, &acc.MasterPasswordHint, &acc.Key, &acc.KdfIterations, &acc.Keys.PublicKey, &acc.Keys.EncryptedPrivateKey, &acc.RefreshToken)
+	// Get account from refresh token.
+	return scanAccount(db.db.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE refreshToken=?", s))
+}
 
-		if err != nil {
-			return acc, err
-		}
+// UpdateDomains saves the custom equivalent domains of an account and the global groups it excluded.
+func (db *DB) UpdateDomains(accId string, equivalentDomains [][]string, excludedGlobalEquivalentDomains []int) error {
+	if equivalentDomains == nil {
+		equivalentDomains = make([][]string, 0)
+	}
+	if excludedGlobalEquivalentDomains == nil {
+		excludedGlobalEquivalentDomains = make([]int, 0)
+	}
+
+	equivalent, err := json.Marshal(equivalentDomains)
+	if err != nil {
+		return err
+	}
+
+	excluded, err := json.Marshal(excludedGlobalEquivalentDomains)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.db.Exec("UPDATE accounts SET equivalentDomains=$1, excludedGlobalEquivalentDomains=$2, revisionDate=$3 WHERE id=$4", string(equivalent), string(excluded), revisionNow(), accId)
+	return err
+}
+
+// UpdateMasterPasswordHash replaces the stored master password hash of an
+// account with one of the same password, the vault doesn't change.
+func (db *DB) UpdateMasterPasswordHash(accId, hash string) error {
+	res, err := db.db.Exec("UPDATE accounts SET masterPasswordHash=$1 WHERE id=$2", hash, accId)
+	if err != nil {
+		return err
+	}
+
+	return affected(res)
+}
+
+// UpdateProfile saves the name, master password hint, culture and avatar
+// color of an account.
+func (db *DB) UpdateProfile(acc ds.Account) error {
+	res, err := db.db.Exec("UPDATE accounts SET name=$1, masterPasswordHint=$2, culture=$3, avatarColor=$4, revisionDate=$5 WHERE id=$6",
+		acc.Name, acc.MasterPasswordHint, acc.Culture, acc.AvatarColor, revisionNow(), acc.Id)
+	if err != nil {
+		return err
+	}
+
+	return affected(res)
+}
+
+// SetEmailToken remembers the address an account wants to change its email
+// to and the token sent there to verify it.
+func (db *DB) SetEmailToken(accId, newEmail, token string, expires time.Time) error {
+	res, err := db.db.Exec("UPDATE accounts SET pendingEmail=$1, emailToken=$2, emailTokenExpires=$3, emailTokenAttempts=0 WHERE id=$4", newEmail, token, expires.Unix(), accId)
+	if err != nil {
+		return err
+	}
+
+	return affected(res)
+}
+
+// CountEmailTokenAttempt counts an attempt to use the email token of an
+// account and returns the attempts made since the token was set.
+func (db *DB) CountEmailTokenAttempt(accId string) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE accounts SET emailTokenAttempts=emailTokenAttempts+1 WHERE id=$1", accId)
+	if err != nil {
+		return 0, err
+	}
+	if err = affected(res); err != nil {
+		return 0, err
+	}
+
+	var attempts int
+	if err = tx.QueryRow("SELECT emailTokenAttempts FROM accounts WHERE id=$1", accId).Scan(&attempts); err != nil {
+		return 0, err
 	}
 
-	return acc, nil
+	return attempts, tx.Commit()
+}
+
+// UpdateEmail moves an account to a new email. The email is the salt of the
+// master key, so the master password hash and the key encrypted with the
+// master key change along. Other clients are logged out like by RotateSecurityStamp.
+func (db *DB) UpdateEmail(accId, newEmail, masterPasswordHash, key string) error {
+	res, err := db.db.Exec("UPDATE accounts SET email=$1, masterPasswordHash=$2, key=$3, refreshToken='', securityStamp=$4, pendingEmail='', emailToken='', emailTokenExpires=0, emailTokenAttempts=0, revisionDate=$5 WHERE id=$6",
+		newEmail, masterPasswordHash, key, newSecurityStamp(), revisionNow(), accId)
+	if err != nil {
+		return err
+	}
+
+	return affected(res)
+}
+
+// UpdateMasterPassword changes the master password of an account, and with
+// it the key encrypted with the master key. Other clients are logged out like
+// by RotateSecurityStamp.
+func (db *DB) UpdateMasterPassword(accId, masterPasswordHash, masterPasswordHint, key string) error {
+	res, err := db.db.Exec("UPDATE accounts SET masterPasswordHash=$1, masterPasswordHint=$2, key=$3, refreshToken='', securityStamp=$4, revisionDate=$5 WHERE id=$6",
+		masterPasswordHash, masterPasswordHint, key, newSecurityStamp(), revisionNow(), accId)
+	if err != nil {
+		return err
+	}
+
+	return affected(res)
+}
+
+// RotateSecurityStamp gives an account a new security stamp, which access
+// tokens carry, and clears its refresh token. Every client has to log in again.
+func (db *DB) RotateSecurityStamp(accId string) error {
+	res, err := db.db.Exec("UPDATE accounts SET securityStamp=$1, refreshToken='', revisionDate=$2 WHERE id=$3", newSecurityStamp(), revisionNow(), accId)
+	if err != nil {
+		return err
+	}
+
+	return affected(res)
+}
+
+func newSecurityStamp() string {
+	return uuid.Must(uuid.NewRandom()).String()
+}
+
+// UpdateKdf switches the account to other KDF settings. Those change the
+// master key, so the master password hash and the key encrypted with the
+// master key change along. Other clients are logged out like by RotateSecurityStamp.
+func (db *DB) UpdateKdf(acc ds.Account) error {
+	res, err := db.db.Exec("UPDATE accounts SET kdf=$1, kdfIterations=$2, kdfMemory=$3, kdfParallelism=$4, masterPasswordHash=$5, key=$6, refreshToken='', securityStamp=$7, revisionDate=$8 WHERE id=$9",
+		acc.Kdf, acc.KdfIterations, acc.KdfMemory, acc.KdfParallelism, acc.MasterPasswordHash, acc.Key, newSecurityStamp(), revisionNow(), acc.Id)
+	if err != nil {
+		return err
+	}
+
+	return affected(res)
+}
+
+// revisionNow returns the current time as stored in accounts.revisionDate,
+// milliseconds so changes within the same second still change the revision.
+func revisionNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// touchAccount bumps the revision date of an account, telling clients its vault changed.
+func (db *DB) touchAccount(accId string) error {
+	_, err := db.db.Exec("UPDATE accounts SET revisionDate=$1 WHERE id=$2", revisionNow(), accId)
+	return err
+}
+
+// affected returns sql.ErrNoRows if res didn't change any row, so objects of
+// other accounts look like they don't exist.
+func affected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 func (db *DB) AddAccount(acc ds.Account) error {
-	stmt, err := db.db.Prepare("INSERT INTO accounts(id, name, email, masterPasswordHash, masterPasswordHint, key, kdfIterations, publicKey, encryptedPrivateKey, refreshToken) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := db.db.Prepare("INSERT INTO accounts(id, name, email, masterPasswordHash, masterPasswordHint, key, kdf, kdfIterations, kdfMemory, kdfParallelism, publicKey, encryptedPrivateKey, refreshToken, revisionDate, securityStamp) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(uuid.Must(uuid.NewRandom()), acc.Name, acc.Email, acc.MasterPasswordHash, acc.MasterPasswordHint, acc.Key, acc.KdfIterations, acc.Keys.PublicKey, acc.Keys.EncryptedPrivateKey, acc.RefreshToken)
+	_, err = stmt.Exec(uuid.Must(uuid.NewRandom()), acc.Name, acc.Email, acc.MasterPasswordHash, acc.MasterPasswordHint, acc.Key, acc.Kdf, acc.KdfIterations, acc.KdfMemory, acc.KdfParallelism, acc.Keys.PublicKey, acc.Keys.EncryptedPrivateKey, acc.RefreshToken, revisionNow(), newSecurityStamp())
 	if err != nil {
 		return err
 	}
@@ -1039,14 +1184,41 @@ func (db *DB) AddAccount(acc ds.Account) error {
 
 func (db *DB) Open() error {
 	var err error
-	if db.dir != "" {
-		db.db, err = sql.Open("sqlite3", path.Join(db.dir, dbFileName))
-	} else {
-		db.db, err = sql.Open("sqlite3", dbFileName)
-	}
+	db.db, err = sql.Open("sqlite3", db.file())
 	return err
 }
 
+// file returns the path of the database file in the configured dir.
+func (db *DB) file() string {
+	return path.Join(db.dir, dbFileName)
+}
+
+// Exists reports whether the database file is already there.
+func (db *DB) Exists() bool {
+	return utils.PathExist(db.file())
+}
+
+// Setup opens the database, creating the tables if it is new and migrating
+// it otherwise. With reset an existing database is deleted first, only do
+// that when asked to.
+func (db *DB) Setup(reset bool) error {
+	if reset && db.Exists() {
+		if err := os.Remove(db.file()); err != nil {
+			return err
+		}
+	}
+
+	fresh := !db.Exists()
+	if err := db.Open(); err != nil {
+		return err
+	}
+
+	if fresh {
+		return db.Init()
+	}
+	return db.Migrate()
+}
+
 func (db *DB) Close() {
 	db.db.Close()
 }
@@ -1055,23 +1227,14 @@ func (db *DB) SetDir(d string) {
 	db.dir = d
 }
 
+// Init creates the tables in the opened, empty database.
 func (db *DB) Init() error {
-	if utils.PathExist(dbFileName) {
-		err := os.Remove(dbFileName)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err := os.Create(dbFileName)
-		if err != nil {
-			return err
-		}
-	}
-
-	for _, sql := range []string{identityTable, cardTable, accountTable, folderTable, cipherTable, loginTable, uriTable, fieldTable, attachmentTable} {
+	for _, sql := range append([]string{accountTable, folderTable, cipherTable, attachmentTable}, indexes...) {
 		if _, err := db.db.Exec(sql); err != nil {
 			return errors.New(fmt.Sprintf("Sql error with %s\n%s", sql, err.Error()))
 		}
 	}
-	return nil
+
+	// Fresh tables already have the latest schema.
+	return db.setSchemaVersion(len(migrations))
 }
@@ -1 +1,596 @@
 package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/404cn/gowarden/ds"
+	"github.com/google/uuid"
+)
+
+// newTestDB creates a fresh database in a temp dir, removed when the test ends.
+func newTestDB(tb testing.TB) *DB {
+	dir, err := ioutil.TempDir("", "gowarden-db")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	db := New()
+	db.SetDir(dir)
+
+	tb.Cleanup(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	if err = db.Open(); err != nil {
+		tb.Fatal(err)
+	}
+	if err = db.Init(); err != nil {
+		tb.Fatal(err)
+	}
+
+	return db
+}
+
+func newTestAccount(tb testing.TB, db *DB, email string) ds.Account {
+	err := db.AddAccount(ds.Account{Email: email, MasterPasswordHash: "hash"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	acc, err := db.GetAccount(email)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return acc
+}
+
+// seedVault inserts n ciphers of every type into the account in one transaction.
+func seedVault(tb testing.TB, db *DB, accId string, n int) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("INSERT INTO ciphers(id, accountId, revisionDate, type, folderId, favorite, dataVersion, data) VALUES(?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	for i := 0; i < n; i++ {
+		cipher := ds.Cipher{
+			Type:   i%4 + 1,
+			Name:   fmt.Sprint("2.name", i),
+			Notes:  "2.notes",
+			Fields: []ds.Field{{Name: "2.field", Value: "2.value"}},
+		}
+
+		switch cipher.Type {
+		case 1:
+			cipher.Login = ds.Login{
+				Username: "2.username",
+				Password: "2.password",
+				Uris:     []ds.Uri{{Uri: "2.uri"}, {Uri: "2.uri2", Match: 1}},
+			}
+		case 3:
+			cipher.Card = ds.Card{CardholderName: "2.holder", Brand: "2.brand", Number: "2.number", Code: "2.code"}
+		case 4:
+			cipher.Identity = ds.Identity{FirstName: "2.first", LastName: "2.last", Email: "2.email"}
+		}
+
+		data, err := marshalCipher(cipher)
+		if err != nil {
+			tb.Fatal(err)
+		}
+
+		_, err = stmt.Exec(uuid.New().String(), accId, now, cipher.Type, "", i%2 == 0, cipherDataVersion, data)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestGetCiphers(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+	other := newTestAccount(t, db, "somebody@example.com")
+
+	var cipher ds.Cipher
+	err := json.Unmarshal([]byte(`{
+		"type": 1,
+		"name": "2.login",
+		"login": {
+			"username": "2.username",
+			"password": "2.password",
+			"uris": [{"uri": "2.uri1"}, {"uri": "2.uri2", "match": 3}],
+			"fido2Credentials": [{"credentialId": "2.id"}]
+		},
+		"fields": [{"type": 1, "name": "2.name", "value": "2.value"}],
+		"passwordHistory": [{"password": "2.old", "lastUsedDate": "2020-05-24T02:12:00Z"}],
+		"reprompt": 1,
+		"lastKnownRevisionDate": "2020-05-24T02:12:00Z"
+	}`), &cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login, err := db.AddCipher(cipher, acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	card, err := db.AddCipher(ds.Cipher{
+		Type: 3,
+		Name: "2.card",
+		Card: ds.Card{CardholderName: "2.holder", Number: "2.number"},
+	}, acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seedVault(t, db, other.Id, 10)
+
+	ciphers, err := db.GetCiphers(acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphers) != 2 {
+		t.Fatalf("Got %d ciphers, want 2", len(ciphers))
+	}
+
+	for _, cipher := range ciphers {
+		switch cipher.Id {
+		case login.Id:
+			if cipher.Login.Username != "2.username" || len(cipher.Login.Uris) != 2 || len(cipher.Fields) != 1 {
+				t.Errorf("Login cipher loaded wrong: %+v", cipher)
+			}
+			if cipher.Data.Username != "2.username" || cipher.Login.Uri != "2.uri1" {
+				t.Errorf("Login cipher data not filled: %+v", cipher.Data)
+			}
+
+			// Members gowarden doesn't know survive, request only ones are dropped.
+			if string(cipher.Extra["reprompt"]) != "1" {
+				t.Errorf("Unknown cipher members lost: %v", cipher.Extra)
+			}
+			if len(cipher.PasswordHistory) != 1 || cipher.PasswordHistory[0].Password != "2.old" || cipher.PasswordHistory[0].LastUsedDate.IsZero() {
+				t.Errorf("Password history lost: %+v", cipher.PasswordHistory)
+			}
+			if _, ok := cipher.Extra["lastKnownRevisionDate"]; ok {
+				t.Errorf("Request only member stored: %v", cipher.Extra)
+			}
+			if cipher.Login.Extra["fido2Credentials"] == nil {
+				t.Errorf("Unknown login members lost: %v", cipher.Login.Extra)
+			}
+		case card.Id:
+			if cipher.Card.CardholderName != "2.holder" || cipher.Login.Uris != nil || cipher.Fields != nil {
+				t.Errorf("Card cipher loaded wrong: %+v", cipher)
+			}
+		default:
+			t.Errorf("Unexpected cipher %v", cipher.Id)
+		}
+	}
+}
+
+func BenchmarkGetCiphers10k(b *testing.B) {
+	db := newTestDB(b)
+	acc := newTestAccount(b, db, "nobody@example.com")
+	seedVault(b, db, acc.Id, 10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ciphers, err := db.GetCiphers(acc.Id)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ciphers) != 10000 {
+			b.Fatalf("Got %d ciphers", len(ciphers))
+		}
+	}
+}
+
+func TestPasswordHistory(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+
+	// Version 1 documents kept password history with the unknown members.
+	_, err := db.db.Exec("INSERT INTO ciphers(id, accountId, revisionDate, type, folderId, favorite, dataVersion, data) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		"old", acc.Id, 1590000000, 1, "", false, 1,
+		`{"Name":"2.name","Notes":"","Login":{"Username":"2.username","Password":"2.new"},"Extra":{"passwordHistory":[{"password":"2.old","lastUsedDate":"2020-05-24T02:12:00Z"}]}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folder, err := db.AddFolder(acc.Id, "2.folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.ImportCiphers(acc.Id, []ds.Folder{{Id: "imported", Name: "2.imported"}}, []ds.Cipher{{
+		Type:            1,
+		Name:            "2.imported",
+		FolderId:        "imported",
+		PasswordHistory: []ds.PasswordHistory{{Password: "2.older", LastUsedDate: time.Unix(1590000000, 0)}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphers, err := db.GetCiphers(acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphers) != 2 {
+		t.Fatalf("Got %d ciphers, want 2", len(ciphers))
+	}
+
+	var ids []string
+	for _, cipher := range ciphers {
+		ids = append(ids, cipher.Id)
+
+		if len(cipher.PasswordHistory) != 1 || len(cipher.Extra) != 0 {
+			t.Errorf("Password history of %v not loaded: %+v %v", cipher.Name, cipher.PasswordHistory, cipher.Extra)
+		}
+
+		if cipher.Id == "old" {
+			cipher.Name = "2.renamed"
+			if _, err = db.UpdateCipher(cipher, acc.Id, nil); err != nil {
+				t.Fatal(err)
+			}
+		} else if cipher.FolderId != "imported" {
+			t.Errorf("Imported cipher not in imported folder: %v", cipher.FolderId)
+		}
+	}
+
+	if err = db.MoveCiphers(acc.Id, folder.Id, ids); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphers, err = db.GetCiphers(acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cipher := range ciphers {
+		if cipher.FolderId != folder.Id {
+			t.Errorf("Cipher %v not moved: %v", cipher.Name, cipher.FolderId)
+		}
+		if len(cipher.PasswordHistory) != 1 {
+			t.Errorf("Password history of %v lost: %+v", cipher.Name, cipher.PasswordHistory)
+		}
+	}
+
+	folders, err := db.GetFolders(acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(folders) != 2 {
+		t.Errorf("Got %d folders, want 2", len(folders))
+	}
+}
+
+func TestDeleteFolder(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+	other := newTestAccount(t, db, "somebody@example.com")
+
+	folder, err := db.AddFolder(acc.Id, "2.folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Revision dates have a resolution of a second.
+	old := time.Now().Add(-time.Hour).Unix()
+	for _, c := range []struct{ id, accId, folderId string }{
+		{"inside", acc.Id, folder.Id},
+		{"outside", acc.Id, ""},
+		{"foreign", other.Id, folder.Id},
+	} {
+		_, err = db.db.Exec("INSERT INTO ciphers(id, accountId, revisionDate, type, folderId, favorite, dataVersion, data) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+			c.id, c.accId, old, 2, c.folderId, false, cipherDataVersion, `{"Name":"2.name"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.DeleteFolder(other.Id, folder.Id); err != sql.ErrNoRows {
+		t.Errorf("Deleting a folder of another account returned %v, want %v", err, sql.ErrNoRows)
+	}
+
+	if err = db.DeleteFolder(acc.Id, folder.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.GetFolder(acc.Id, folder.Id); err != sql.ErrNoRows {
+		t.Errorf("Deleted folder is still there: %v", err)
+	}
+
+	for _, c := range []struct {
+		id, accId, folderId string
+		touched             bool
+	}{
+		{"inside", acc.Id, "", true},
+		{"outside", acc.Id, "", false},
+		{"foreign", other.Id, folder.Id, false},
+	} {
+		cipher, err := db.GetCipher(c.accId, c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cipher.FolderId != c.folderId {
+			t.Errorf("Cipher %v is in folder %q, want %q", c.id, cipher.FolderId, c.folderId)
+		}
+		if touched := cipher.RevisionDate.Unix() != old; touched != c.touched {
+			t.Errorf("Cipher %v revision date changed: %v, want %v", c.id, touched, c.touched)
+		}
+	}
+}
+
+func TestUpdateCipherPartial(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+
+	folder, err := db.AddFolder(acc.Id, "2.folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := db.AddCipher(ds.Cipher{
+		Type:  1,
+		Name:  "2.name",
+		Login: ds.Login{Username: "2.username", Password: "2.password"},
+	}, acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.UpdateCipherPartial(acc.Id, "missing", folder.Id, true); err != sql.ErrNoRows {
+		t.Errorf("Updating a missing cipher returned %v, want %v", err, sql.ErrNoRows)
+	}
+	other := newTestAccount(t, db, "somebody@example.com")
+	if _, err = db.UpdateCipher(ds.Cipher{Id: added.Id, Type: 2, Name: "2.name"}, other.Id, nil); err != sql.ErrNoRows {
+		t.Errorf("Updating the cipher of another account returned %v, want %v", err, sql.ErrNoRows)
+	}
+
+	cipher, err := db.UpdateCipherPartial(acc.Id, added.Id, folder.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cipher.FolderId != folder.Id || !cipher.Favorite {
+		t.Errorf("Got folder %q and favorite %v, want %q and true", cipher.FolderId, cipher.Favorite, folder.Id)
+	}
+	if cipher.Name != added.Name || cipher.Login.Username != added.Login.Username || cipher.Login.Password != added.Login.Password {
+		t.Errorf("Content changed: %+v", cipher)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+	other := newTestAccount(t, db, "somebody@example.com")
+
+	vault := func(accId string) string {
+		if _, err := db.AddFolder(accId, "2.folder"); err != nil {
+			t.Fatal(err)
+		}
+		cipher, err := db.AddCipher(ds.Cipher{Type: 2, Name: "2.name"}, accId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.AddAttachment(accId, cipher.Id, ds.Attachment{Id: uuid.New().String(), FileName: "2.file", Size: "4"}); err != nil {
+			t.Fatal(err)
+		}
+		return cipher.Id
+	}
+	cipherId := vault(acc.Id)
+	otherCipherId := vault(other.Id)
+
+	count := func(table, accId string) int {
+		var n int
+		query := "SELECT COUNT(*) FROM " + table + " WHERE accountId=$1"
+		if table == "attachments" {
+			query = "SELECT COUNT(*) FROM attachments WHERE cipherId IN (SELECT id FROM ciphers WHERE accountId=$1)"
+		}
+		if err := db.db.QueryRow(query, accId).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	cipherIds, err := db.PurgeVault(acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cipherIds) != 1 || cipherIds[0] != cipherId {
+		t.Errorf("PurgeVault deleted ciphers %v, want %v", cipherIds, cipherId)
+	}
+
+	var n int
+	if err = db.db.QueryRow("SELECT COUNT(*) FROM attachments WHERE cipherId=$1", cipherId).Scan(&n); err != nil || n != 0 {
+		t.Errorf("%v attachments of purged ciphers left: %v", n, err)
+	}
+	for _, table := range []string{"folders", "ciphers"} {
+		if n := count(table, acc.Id); n != 0 {
+			t.Errorf("%v %v left after purging", n, table)
+		}
+	}
+	if _, err = db.GetAccount(acc.Email); err != nil {
+		t.Errorf("Purging deleted the account: %v", err)
+	}
+
+	vault(acc.Id)
+	if _, err = db.DeleteAccount(acc.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetAccount(acc.Email); err != sql.ErrNoRows {
+		t.Errorf("Deleted account is still there: %v", err)
+	}
+	for _, table := range []string{"folders", "ciphers"} {
+		if n := count(table, acc.Id); n != 0 {
+			t.Errorf("%v %v left after deleting the account", n, table)
+		}
+	}
+	if _, err = db.DeleteAccount(acc.Id); err != sql.ErrNoRows {
+		t.Errorf("Deleting a missing account returned %v, want %v", err, sql.ErrNoRows)
+	}
+
+	for _, table := range []string{"folders", "ciphers", "attachments"} {
+		if n := count(table, other.Id); n != 1 {
+			t.Errorf("Other account has %v %v, want 1", n, table)
+		}
+	}
+	if _, err = db.GetCipher(other.Id, otherCipherId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAccountRevisionDate(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+
+	revision := func() time.Time {
+		acc, err := db.GetAccount(acc.Email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acc.RevisionDate
+	}
+
+	old := revision()
+	time.Sleep(2 * time.Millisecond)
+	if err := db.UpdateRefreshToken(acc.Id, "token"); err != nil {
+		t.Fatal(err)
+	}
+	if !revision().Equal(old) {
+		t.Error("Saving the refresh token changed the revision date")
+	}
+
+	if err := db.UpdateKeys(acc.Id, ds.Keys{PublicKey: "key", EncryptedPrivateKey: "2.key"}); err != nil {
+		t.Fatal(err)
+	}
+	if !revision().After(old) {
+		t.Error("Saving the keys didn't change the revision date")
+	}
+
+	if err := db.UpdateRefreshToken("missing", "token"); err != sql.ErrNoRows {
+		t.Errorf("Updating a missing account returned %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestCountEmailTokenAttempt(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+
+	for want := 1; want <= 2; want++ {
+		if attempts, err := db.CountEmailTokenAttempt(acc.Id); err != nil || attempts != want {
+			t.Errorf("Got attempt %v, %v, want %v", attempts, err, want)
+		}
+	}
+
+	if err := db.SetEmailToken(acc.Id, "somebody@example.com", "123456", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if attempts, err := db.CountEmailTokenAttempt(acc.Id); err != nil || attempts != 1 {
+		t.Errorf("A new token starts at attempt %v, %v", attempts, err)
+	}
+
+	if _, err := db.CountEmailTokenAttempt("missing"); err != sql.ErrNoRows {
+		t.Errorf("Counting for a missing account returned %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestSetupKeepsExistingDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowarden-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Not the working directory, like with -d.
+	db := New()
+	db.SetDir(dir)
+	if db.Exists() {
+		t.Fatal("Database exists before it is created")
+	}
+	if err = db.Setup(false); err != nil {
+		t.Fatal(err)
+	}
+	newTestAccount(t, db, "nobody@example.com")
+	db.Close()
+
+	restart := func(reset bool) *DB {
+		db := New()
+		db.SetDir(dir)
+		if !db.Exists() {
+			t.Fatal("Database doesn't exist after a restart")
+		}
+		if err := db.Setup(reset); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db = restart(false)
+	if _, err = db.GetAccount("nobody@example.com"); err != nil {
+		t.Errorf("Account is gone after a restart: %v", err)
+	}
+	db.Close()
+
+	db = restart(true)
+	defer db.Close()
+	if _, err = db.GetAccount("nobody@example.com"); err != sql.ErrNoRows {
+		t.Errorf("Account survived resetting the database: %v", err)
+	}
+}
+
+func TestUpdateCipherLastKnownRevision(t *testing.T) {
+	db := newTestDB(t)
+	acc := newTestAccount(t, db, "nobody@example.com")
+
+	added, err := db.AddCipher(ds.Cipher{Type: 2, Name: "2.name"}, acc.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make the cipher older, so updates now are later than what clients saw.
+	seen := time.Now().Add(-time.Hour)
+	if _, err = db.db.Exec("UPDATE ciphers SET revisionDate=$1 WHERE id=$2", seen.Unix(), added.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients that saw the same revision update at once, only one may win.
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			_, err := db.UpdateCipher(ds.Cipher{Id: added.Id, Type: 2, Name: fmt.Sprintf("2.name%d", i)}, acc.Id, &seen)
+			errs <- err
+		}(i)
+	}
+	var updated int
+	for i := 0; i < 8; i++ {
+		switch err := <-errs; err {
+		case nil:
+			updated++
+		case ds.ErrOutOfDate:
+		default:
+			t.Error(err)
+		}
+	}
+	if updated != 1 {
+		t.Errorf("%d clients updated the cipher, want 1", updated)
+	}
+
+	if _, err = db.UpdateCipher(ds.Cipher{Id: "missing", Type: 2, Name: "2.name"}, acc.Id, &seen); err != sql.ErrNoRows {
+		t.Errorf("Updating a missing cipher returned %v, want %v", err, sql.ErrNoRows)
+	}
+}
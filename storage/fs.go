@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FS stores blobs as files below a local directory.
+type FS struct {
+	dir string
+}
+
+func NewFS(dir string) *FS {
+	return &FS{dir: dir}
+}
+
+// path maps key to a file below fs.dir and refuses keys escaping it.
+func (fs *FS) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+strings.TrimSuffix(key, "/") {
+		return "", errors.New("invalid blob key: " + key)
+	}
+	return filepath.Join(fs.dir, filepath.FromSlash(clean)), nil
+}
+
+func (fs *FS) Put(key string, r io.Reader, size int64) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so readers never see a half written blob.
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return io.ErrUnexpectedEOF
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+func (fs *FS) Get(key string) (io.ReadCloser, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return f, err
+}
+
+func (fs *FS) Delete(key string) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *FS) DeleteAll(prefix string) error {
+	p, err := fs.path(prefix)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+// SignedURL always returns "", files have to be served by gowarden itself.
+func (fs *FS) SignedURL(key string, expires time.Duration) (string, error) {
+	return "", nil
+}
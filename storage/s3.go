@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3UnsignedBody   = "UNSIGNED-PAYLOAD"
+	s3EmptyBodyHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat     = "20060102T150405Z"
+	s3DateFormat     = "20060102"
+	s3MaxPresignTime = 7 * 24 * time.Hour
+)
+
+// S3Config describes how to reach an S3 compatible bucket (AWS, MinIO, ...).
+type S3Config struct {
+	// Endpoint is the base url of the service, e.g. https://s3.amazonaws.com
+	// or http://127.0.0.1:9000 for a local MinIO.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle puts the bucket into the path instead of the host name,
+	// MinIO and most self hosted services need it.
+	PathStyle bool
+}
+
+// S3 stores blobs in a bucket of an S3 compatible object storage. Requests
+// are signed with AWS signature version 4.
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3: bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+
+	return &S3{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Minute},
+		now:      time.Now,
+	}, nil
+}
+
+// objectURL returns the url of key, or of the bucket itself if key is "".
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	p := strings.TrimSuffix(u.Path, "/")
+	if s.cfg.PathStyle {
+		p += "/" + s.cfg.Bucket
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = p + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	return &u
+}
+
+func (s *S3) Put(key string, r io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	// Let the body stream through instead of buffering it to hash it.
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	res, err := s.do(req, s3UnsignedBody)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.do(req, s3EmptyBodyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotExist
+	default:
+		defer res.Body.Close()
+		return nil, s3Error(res)
+	}
+}
+
+func (s *S3) Delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(req, s3EmptyBodyHash)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error(res)
+	}
+	return nil
+}
+
+func (s *S3) DeleteAll(prefix string) error {
+	keys, err := s.list(strings.TrimSuffix(prefix, "/") + "/")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list returns all keys starting with prefix, following continuation tokens.
+func (s *S3) list(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+
+	for {
+		u := s.objectURL("")
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return keys, err
+		}
+
+		res, err := s.do(req, s3EmptyBodyHash)
+		if err != nil {
+			return keys, err
+		}
+
+		if res.StatusCode != http.StatusOK {
+			err = s3Error(res)
+			res.Body.Close()
+			return keys, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return keys, err
+		}
+
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// SignedURL returns a presigned GET url for key.
+func (s *S3) SignedURL(key string, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > s3MaxPresignTime {
+		return "", fmt.Errorf("s3: invalid presign expiry %v", expires)
+	}
+
+	u := s.objectURL(key)
+	t := s.now().UTC()
+
+	q := u.Query()
+	q.Set("X-Amz-Algorithm", s3Algorithm)
+	q.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+s.scope(t))
+	q.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	q.Set("X-Amz-Expires", strconv.FormatInt(int64(expires/time.Second), 10))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(q)
+
+	header := http.Header{}
+	header.Set("Host", u.Host)
+	canonical, _ := canonicalRequest(http.MethodGet, u, header, s3UnsignedBody)
+
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(t, canonical)
+	return u.String(), nil
+}
+
+// do signs req with the Authorization header and sends it.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	t := s.now().UTC()
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", t.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	canonical, signedHeaders := canonicalRequest(req.Method, req.URL, req.Header, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKey, s.scope(t), signedHeaders, s.signature(t, canonical)))
+	req.Header.Del("Host")
+
+	return s.client.Do(req)
+}
+
+func (s *S3) scope(t time.Time) string {
+	return t.Format(s3DateFormat) + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+func (s *S3) signature(t time.Time, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := s3Algorithm + "\n" + t.Format(s3TimeFormat) + "\n" + s.scope(t) + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), t.Format(s3DateFormat))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalRequest builds the canonical request of signature version 4 and
+// returns it together with the list of signed headers.
+func canonicalRequest(method string, u *url.URL, header http.Header, payloadHash string) (string, string) {
+	var names []string
+	for name := range header {
+		lname := strings.ToLower(name)
+		if lname == "host" || lname == "content-type" || strings.HasPrefix(lname, "x-amz-") {
+			names = append(names, lname)
+		}
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + strings.TrimSpace(header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query, _ := url.ParseQuery(u.RawQuery)
+
+	return strings.Join([]string{
+		method,
+		uriEncode(u.Path, false),
+		canonicalQuery(query),
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+func canonicalQuery(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent encodes everything but the unreserved characters,
+// keeping "/" as is unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Error(res *http.Response) error {
+	var body struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&body)
+	if body.Code == "" {
+		return fmt.Errorf("s3: %s", res.Status)
+	}
+	return fmt.Errorf("s3: %s: %s %s", res.Status, body.Code, body.Message)
+}
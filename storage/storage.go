@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotExist is returned when a blob can't be found in the store.
+var ErrNotExist = errors.New("blob does not exist")
+
+// Store keeps the opaque blobs (attachments, send files) gowarden has to
+// persist. The blobs are already encrypted by clients, a store only moves bytes.
+//
+// Keys are slash separated, e.g. "<cipherId>/<attachmentId>".
+type Store interface {
+	// Put streams size bytes from r into key, replacing any existing blob.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens key for reading. The returned reader implements io.Seeker
+	// when the store supports random access.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes key, deleting a missing blob is not an error.
+	Delete(key string) error
+	// DeleteAll removes every blob whose key starts with prefix + "/".
+	DeleteAll(prefix string) error
+	// SignedURL returns an url the client can download key from directly
+	// before expires passed, or "" if the store can't hand out direct links.
+	SignedURL(key string, expires time.Duration) (string, error)
+}